@@ -0,0 +1,3 @@
+module ttftp
+
+go 1.22
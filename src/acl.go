@@ -0,0 +1,154 @@
+package main
+
+import(
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "path"
+    "strings"
+    "sync"
+)
+
+// ---------------------------------
+// Access Control Lists
+// ---------------------------------
+// Rules are evaluated in order in the control loop before a session is
+// spawned, the first matching rule decides. One rule per line :
+//
+//   <allow|deny> <read|write|any> <cidr|any> <pattern>
+//
+// A pattern of a lone '*' matches every key, one ending with '/' every key
+// under that prefix, anything else is a glob as understood by path.Match
+// ( its '*' does not cross '/', "*/*.img" is needed for "a/b.img" ). Blank
+// lines and lines starting with '#' are ignored. Example :
+//
+//   allow write 10.1.0.0/16  builds/
+//   allow read  10.2.0.0/16  *
+//   deny  any   any          *
+type AclRule struct {
+    allow bool
+    op string
+    network *net.IPNet
+    pattern string
+    line int
+}
+
+var acl_log = new_logger("ACL")
+
+var acl = struct {
+    sync.RWMutex
+    rules []AclRule
+    default_allow bool
+} { default_allow : true }
+
+func parse_acl(r io.Reader) (rules []AclRule, err error) {
+    scanner := bufio.NewScanner(r)
+    line := 0
+    for scanner.Scan() {
+        line++
+        text := strings.TrimSpace(scanner.Text())
+        if text == "" || strings.HasPrefix(text, "#") {
+            continue
+        }
+
+        fields := strings.Fields(text)
+        if len(fields) != 4 {
+            return nil, fmt.Errorf("acl line %d : expected 4 fields, got %d", line, len(fields))
+        }
+
+        rule := AclRule{ line : line }
+        if fields[0] == "allow" {
+            rule.allow = true
+        } else if fields[0] != "deny" {
+            return nil, fmt.Errorf("acl line %d : unknown action %q", line, fields[0])
+        }
+
+        if fields[1] != "read" && fields[1] != "write" && fields[1] != "any" {
+            return nil, fmt.Errorf("acl line %d : unknown operation %q", line, fields[1])
+        }
+        rule.op = fields[1]
+
+        if fields[2] != "any" {
+            cidr := fields[2]
+            if strings.Contains(cidr, "/") == false {
+                // a bare address is a single host
+                if strings.Contains(cidr, ":") {
+                    cidr += "/128"
+                } else {
+                    cidr += "/32"
+                }
+            }
+            _, network, err := net.ParseCIDR(cidr)
+            if err != nil {
+                return nil, fmt.Errorf("acl line %d : %s", line, err.Error())
+            }
+            rule.network = network
+        }
+
+        if _, err := path.Match(fields[3], ""); err != nil {
+            return nil, fmt.Errorf("acl line %d : bad pattern %q", line, fields[3])
+        }
+        rule.pattern = fields[3]
+
+        rules = append(rules, rule)
+    }
+    return rules, scanner.Err()
+}
+
+func load_acl(filename string) (error) {
+    f, err := os.Open(filename)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    rules, err := parse_acl(f)
+    if err != nil {
+        return err
+    }
+
+    acl.Lock()
+    acl.rules = rules
+    acl.Unlock()
+
+    acl_log.infof("Loaded %d rules from %s", len(rules), filename)
+    return nil
+}
+
+func (rule *AclRule) matches(ip net.IP, op string, key string) (bool) {
+    if rule.op != "any" && rule.op != op {
+        return false
+    }
+    if rule.network != nil && rule.network.Contains(ip) == false {
+        return false
+    }
+    return match_key(rule.pattern, key)
+}
+
+// A lone '*' is every key, a pattern ending with '/' a prefix, anything else
+// a path.Match glob
+func match_key(pattern string, key string) (bool) {
+    if pattern == "*" {
+        return true
+    }
+    if strings.HasSuffix(pattern, "/") {
+        return strings.HasPrefix(key, pattern)
+    }
+    matched, _ := path.Match(pattern, key)
+    return matched
+}
+
+// op is "read" or "write"
+func acl_allows(ip net.IP, op string, key string) (bool) {
+    acl.RLock()
+    defer acl.RUnlock()
+
+    for i := range acl.rules {
+        if acl.rules[i].matches(ip, op, key) {
+            return acl.rules[i].allow
+        }
+    }
+    return acl.default_allow
+}
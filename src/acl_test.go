@@ -0,0 +1,89 @@
+package main
+
+import(
+    "net"
+    "strings"
+    "testing"
+)
+
+// The example of the documentation
+const acl_example = `
+# builds are uploaded from the build subnet, the lab only reads
+allow write 10.1.0.0/16  builds/
+allow read  10.2.0.0/16  *
+deny  any   any          *
+`
+
+func TestParseAcl(t *testing.T) {
+    tests := []struct {
+        name string
+        text string
+        n int
+        err bool
+    }{
+        { "example", acl_example, 3, false },
+        { "empty", "\n# nothing\n", 0, false },
+        { "single host", "allow read 10.0.0.1 *\nallow read ::1 *", 2, false },
+        { "glob", "deny write any */*.img", 1, false },
+        { "too few fields", "allow read any", 0, true },
+        { "unknown action", "permit read any *", 0, true },
+        { "unknown operation", "allow list any *", 0, true },
+        { "bad cidr", "allow read 10.0.0.0/33 *", 0, true },
+        { "bad pattern", "allow read any [", 0, true },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rules, err := parse_acl(strings.NewReader(tt.text))
+            if (err != nil) != tt.err {
+                t.Fatalf("got error %v, want error %v", err, tt.err)
+            }
+            if len(rules) != tt.n {
+                t.Errorf("got %d rules, want %d", len(rules), tt.n)
+            }
+        })
+    }
+}
+
+func TestAclAllows(t *testing.T) {
+    example, err := parse_acl(strings.NewReader(acl_example))
+    if err != nil {
+        t.Fatal(err)
+    }
+    globs, err := parse_acl(strings.NewReader("allow read any */*.img\nallow read any cfg?\ndeny any any *"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        rules []AclRule
+        ip string
+        op string
+        key string
+        want bool
+    }{
+        { example, "10.1.2.3", "write", "builds/x", true },
+        { example, "10.1.2.3", "write", "builds/a/b", true },
+        { example, "10.1.2.3", "write", "other", false },
+        { example, "10.2.0.1", "read", "a/b/c", true },
+        { example, "10.2.0.1", "write", "builds/x", false },
+        { example, "10.2.0.1", "write", "a/b", false },
+        { example, "10.2.0.1", "write", "x", false },
+        { example, "192.0.2.1", "read", "builds/x", false },
+        { globs, "192.0.2.1", "read", "a/b.img", true },
+        { globs, "192.0.2.1", "read", "a/b/c.img", false },
+        { globs, "192.0.2.1", "read", "cfg1", true },
+        { globs, "192.0.2.1", "read", "cfg/1", false },
+    }
+    defer func() {
+        acl.Lock()
+        acl.rules = nil
+        acl.Unlock()
+    }()
+    for _, tt := range tests {
+        acl.Lock()
+        acl.rules = tt.rules
+        acl.Unlock()
+        if got := acl_allows(net.ParseIP(tt.ip), tt.op, tt.key); got != tt.want {
+            t.Errorf("%s of %q by %s : got %v, want %v", tt.op, tt.key, tt.ip, got, tt.want)
+        }
+    }
+}
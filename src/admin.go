@@ -0,0 +1,198 @@
+package main
+
+import(
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "ttftp/tftp"
+)
+
+// ---------------------------------
+// Server Modes
+// ---------------------------------
+// - normal      : RRQ and WRQ are served
+// - read-only   : WRQ is refused with an access violation
+// - write-only  : drop-box, RRQ is refused with an access violation
+// - maintenance : new sessions are refused, active ones run to completion
+var server_modes = []string{ "normal", "read-only", "write-only", "maintenance" }
+
+var admin_log = new_logger("ADMIN")
+
+var server_state = struct {
+    sync.RWMutex
+    mode string
+} { mode : "normal" }
+
+func set_server_mode(mode string) (error) {
+    for _, m := range server_modes {
+        if m == mode {
+            server_state.Lock()
+            server_state.mode = mode
+            server_state.Unlock()
+            server_log.infof("Server mode set to %s", mode)
+            return nil
+        }
+    }
+    return fmt.Errorf("unknown server mode %q, expected one of %s", mode, strings.Join(server_modes, " | "))
+}
+
+func get_server_mode() (string) {
+    server_state.RLock()
+    defer server_state.RUnlock()
+    return server_state.mode
+}
+
+// Decides if a request with the given opcode may start a session in the
+// current mode, if not returns the ERROR to answer with
+func check_server_mode(opcode uint16) (ok bool, code uint16, msg string) {
+    mode := get_server_mode()
+    if mode == "maintenance" {
+        return false, tftp.NotDefined, "Server is in maintenance, please retry later"
+    } else if mode == "read-only" && opcode == 1 {
+        return false, tftp.AccessViolation, "Server is read-only"
+    } else if mode == "write-only" && opcode == 2 {
+        return false, tftp.AccessViolation, "Server is write-only"
+    }
+    return true, 0, ""
+}
+
+// ---------------------------------
+// Admin Control Channel
+// ---------------------------------
+// A line oriented text protocol on a local TCP address or a unix socket ( any
+// address containing a '/' ). Each line is a command, each reply ends with a
+// line which is either "ok" or "error: <reason>". Usable with nc or with
+// `ttftp -ctl "<command>"`
+type AdminCommand struct {
+    usage string
+    run func(args []string, w io.Writer) error
+}
+
+var admin_commands = map[string]AdminCommand{}
+
+func init() {
+    admin_commands["help"] = AdminCommand{ "help", admin_help }
+    admin_commands["mode"] = AdminCommand{ "mode [normal|read-only|write-only|maintenance]", admin_mode }
+}
+
+func admin_help(args []string, w io.Writer) (error) {
+    names := make([]string, 0, len(admin_commands))
+    for name := range admin_commands {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        fmt.Fprintf(w, "%s\n", admin_commands[name].usage)
+    }
+    return nil
+}
+
+func admin_mode(args []string, w io.Writer) (error) {
+    if len(args) == 0 {
+        fmt.Fprintf(w, "%s\n", get_server_mode())
+        return nil
+    }
+    return set_server_mode(args[0])
+}
+
+func admin_network(addr string) (string) {
+    if strings.Contains(addr, "/") {
+        return "unix"
+    }
+    return "tcp"
+}
+
+func start_admin(addr string) (error) {
+    network := admin_network(addr)
+    if network == "unix" {
+        // a stale socket from a previous run would make Listen fail
+        os.Remove(addr)
+    }
+    ln, err := net.Listen(network, addr)
+    if err != nil {
+        return err
+    }
+    admin_log.infof("Listening on %s %s", network, addr)
+
+    go admin_accept(ln)
+    return nil
+}
+
+// Accepts admin connections until the listener is closed, backing off while
+// Accept fails ( e.g. out of file descriptors )
+func admin_accept(ln net.Listener) {
+    var backoff time.Duration
+    for {
+        conn, err := ln.Accept()
+        if errors.Is(err, net.ErrClosed) == true {
+            return
+        }
+        if err != nil {
+            backoff = min(max(2 * backoff, 5 * time.Millisecond), time.Second)
+            admin_log.warnf("accept failed, retrying in %s : %s", backoff, err.Error())
+            time.Sleep(backoff)
+            continue
+        }
+        backoff = 0
+        go admin_session(conn)
+    }
+}
+
+func admin_session(conn net.Conn) {
+    defer conn.Close()
+
+    scanner := bufio.NewScanner(conn)
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) == 0 {
+            continue
+        }
+        admin_log.infof("command=%q, src=%s", strings.Join(fields, " "), conn.RemoteAddr().String())
+
+        w := bufio.NewWriter(conn)
+        cmd, ok := admin_commands[fields[0]]
+        if ok == false {
+            fmt.Fprintf(w, "error: unknown command %q, try help\n", fields[0])
+        } else if err := cmd.run(fields[1:], w); err != nil {
+            fmt.Fprintf(w, "error: %s\n", err.Error())
+        } else {
+            fmt.Fprintf(w, "ok\n")
+        }
+        if w.Flush() != nil {
+            return
+        }
+    }
+}
+
+// Client side of the admin channel, sends one command and copies the reply
+// to stdout. Returns false if the server answered with an error
+func admin_ctl(addr string, command string) (bool) {
+    conn, err := net.Dial(admin_network(addr), addr)
+    chk_err(err)
+    defer conn.Close()
+
+    _, err = fmt.Fprintf(conn, "%s\n", command)
+    chk_err(err)
+
+    scanner := bufio.NewScanner(conn)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if line == "ok" {
+            return true
+        }
+        if strings.HasPrefix(line, "error: ") {
+            fmt.Fprintln(os.Stderr, line)
+            return false
+        }
+        fmt.Println(line)
+    }
+    chk_err(scanner.Err())
+    return false
+}
@@ -0,0 +1,121 @@
+package main
+
+import(
+    "flag"
+    "fmt"
+    "sync"
+    "time"
+    "ttftp/tftp"
+)
+
+// ---------------------------------
+// Reflection And Amplification Protection
+// ---------------------------------
+// The source of a request is unverified until a packet comes back from it on
+// the session TID, which a spoofed source never does. Until then :
+// - a session may send at most -unverified-bytes to its peer ( retransmits
+//   included ), after which it is aborted as a suspected spoof
+// - everything sent to unverified peers of a given source IP, including the
+//   ERRORs answered by the control loop, is charged to a budget of
+//   -response-budget bytes per -budget-window. Past it we stay silent. What a
+//   session sent is refunded once its peer answers, so the budget is only
+//   used up by peers that never do
+// - with -rrq-handshake-size, an RRQ for a file larger than that is only
+//   served after an OACK handshake, so the first packet sent is a small one
+// The default covers a lost first DATA of the default block size and all of
+// its -retries resends, with room to spare
+var unverifiedBytes = flag.Int("unverified-bytes", 8 * (tftp.BlockSize + tftp.DataHeaderBytes), "max bytes a session sends to a peer before it ACKs, 0 is unlimited")
+var responseBudget = flag.Int("response-budget", 1024 * 1024, "max bytes sent to unverified peers per source IP and budget window, 0 is unlimited")
+var budgetWindow = flag.Duration("budget-window", time.Minute, "window over which -response-budget applies")
+var rrqHandshakeSize = flag.Int("rrq-handshake-size", 0, "RRQs for files larger than this must negotiate options ( OACK handshake ) first, 0 disables")
+
+type ResponseBudget struct {
+    used int
+    window_start time.Time
+}
+
+var budgets = struct {
+    sync.Mutex
+    b map[string]*ResponseBudget
+    last_prune time.Time
+} { b : make(map[string]*ResponseBudget) }
+
+// Charges n bytes sent to an unverified peer to the budget of its source IP,
+// returns false ( and charges nothing ) when the budget would be exceeded
+func charge_unverified(ip string, n int) (bool) {
+    if *responseBudget <= 0 {
+        return true
+    }
+
+    budgets.Lock()
+    defer budgets.Unlock()
+
+    now := time.Now()
+    if now.Sub(budgets.last_prune) > *budgetWindow {
+        for k, b := range budgets.b {
+            if now.Sub(b.window_start) > *budgetWindow {
+                delete(budgets.b, k)
+            }
+        }
+        budgets.last_prune = now
+    }
+
+    b, ok := budgets.b[ip]
+    if ok == false || now.Sub(b.window_start) > *budgetWindow {
+        b = &ResponseBudget{ window_start : now }
+        budgets.b[ip] = b
+    }
+    if b.used + n > *responseBudget {
+        count("amp_budget_exhausted")
+        return false
+    }
+    b.used += n
+    return true
+}
+
+// Gives back n bytes charged to the budget of ip, once the peer they were sent
+// to turned out not to be spoofed
+func refund_unverified(ip string, n int) {
+    budgets.Lock()
+    defer budgets.Unlock()
+
+    if b, ok := budgets.b[ip]; ok == true {
+        b.used = max(b.used - n, 0)
+    }
+}
+
+// What a session has sent to its peer before the peer proved that it really
+// is at the address the request came from
+type PeerGuard struct {
+    ip string
+    verified bool
+    unverified_bytes int
+}
+
+// The peer answered on the session TID, refund what it was sent so far
+func (g *PeerGuard) verify() {
+    if g.verified == true {
+        return
+    }
+    g.verified = true
+    refund_unverified(g.ip, g.unverified_bytes)
+}
+
+// Returns an error when n more bytes may not be sent to an unverified peer :
+// either the session sent it all it may, the peer is a suspected spoof, or the
+// source IP used up its budget
+func (g *PeerGuard) may_send(n int) (error) {
+    if g.verified == true {
+        return nil
+    }
+    if *unverifiedBytes > 0 && g.unverified_bytes + n > *unverifiedBytes {
+        count("amp_unverified_cap_hit")
+        count("amp_suspected_spoof")
+        return fmt.Errorf("peer never acknowledged %d bytes, suspected spoofed source", g.unverified_bytes)
+    }
+    if charge_unverified(g.ip, n) == false {
+        return fmt.Errorf("response budget of %s exhausted", g.ip)
+    }
+    g.unverified_bytes += n
+    return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import(
+    "bufio"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+    "ttftp/tftp"
+)
+
+// ---------------------------------
+// Transfer Audit Log
+// ---------------------------------
+// With -audit-log every completed, failed and refused transfer, and every
+// upload or delete over the HTTP API, is appended to a file as one JSON object
+// per line. Each record carries the SHA-256 of the previous line ( "prev" ),
+// the first one 64 zeros, so removing or editing a record breaks the chain
+// from there on. A restarted server continues the chain of an existing file.
+// -audit-verify checks a file and exits.
+//
+// Records are queued and written by a goroutine of their own, which syncs the
+// file once per batch, so neither the control loop nor the sessions wait on
+// the disk. Requests refused by the rate limit are not audited one by one, a
+// record per source IP every audit_rate_limited_period carries their count
+type AuditRecord struct {
+    Time time.Time `json:"time"`
+    Session uint64 `json:"session,omitempty"`
+    Peer string `json:"peer"`
+    Op string `json:"op"`
+    Via string `json:"via,omitempty"`
+    Key string `json:"key"`
+    Offset int64 `json:"offset,omitempty"`
+    Size int64 `json:"size"`
+    Sha256 string `json:"sha256,omitempty"`
+    Outcome string `json:"outcome"`
+    ErrorCode *uint16 `json:"error_code,omitempty"`
+    Error string `json:"error,omitempty"`
+    Count int `json:"count,omitempty"`
+    Prev string `json:"prev"`
+}
+
+var auditLog = flag.String("audit-log", "", "file to append the transfer audit log to, empty disables")
+var auditVerify = flag.String("audit-verify", "", "verify the hash chain of an audit log file and exit")
+
+var audit_log = new_logger("AUDIT")
+
+const(
+    audit_queue_sz int = 4096
+    audit_rate_limited_period time.Duration = 10 * time.Second
+)
+
+var auditlog = struct {
+    sync.Mutex
+    queue chan *AuditRecord
+    rate_limited map[string]int
+} {}
+
+var audit_genesis = strings.Repeat("0", 2 * sha256.Size)
+
+func audit_hash(line []byte) (string) {
+    sum := sha256.Sum256(line)
+    return hex.EncodeToString(sum[:])
+}
+
+// Opens the audit log for appending, picking up the chain where it ends
+func start_audit(filename string) (error) {
+    prev := audit_genesis
+    if f, err := os.Open(filename); err == nil {
+        scanner := bufio.NewScanner(f)
+        scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024)
+        for scanner.Scan() {
+            if len(scanner.Bytes()) > 0 {
+                prev = audit_hash(scanner.Bytes())
+            }
+        }
+        err = scanner.Err()
+        f.Close()
+        if err != nil {
+            return err
+        }
+    }
+
+    f, err := os.OpenFile(filename, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0640)
+    if err != nil {
+        return err
+    }
+    queue := make(chan *AuditRecord, audit_queue_sz)
+    auditlog.Lock()
+    auditlog.queue = queue
+    auditlog.rate_limited = make(map[string]int)
+    auditlog.Unlock()
+    go audit_writer(f, prev, queue)
+    audit_log.infof("Appending transfer audit records to %s", filename)
+    return nil
+}
+
+// Queues a record for the writer. Unless wait is set, a record which finds
+// the queue full is dropped rather than hold up the caller
+func write_audit(rec *AuditRecord, wait bool) {
+    auditlog.Lock()
+    queue := auditlog.queue
+    auditlog.Unlock()
+    if queue == nil {
+        return
+    }
+
+    rec.Time = time.Now().UTC()
+    if wait == true {
+        queue <- rec
+        return
+    }
+    select {
+    case queue <- rec:
+    default:
+        count("audit_dropped")
+        audit_log.errorf("Audit queue full, dropping record, Op=%s, Key=%s, Peer=%s", rec.Op, rec.Key, rec.Peer)
+    }
+}
+
+// Appends whatever is queued as one batch, and the rate limited requests
+// counted so far every audit_rate_limited_period
+func audit_writer(f *os.File, prev string, queue chan *AuditRecord) {
+    ticker := time.NewTicker(audit_rate_limited_period)
+    defer ticker.Stop()
+    for {
+        var batch []*AuditRecord
+        select {
+        case rec := <-queue:
+            batch = drain_audit(queue, append(batch, rec))
+        case <-ticker.C:
+            batch = take_rate_limited()
+        }
+        if len(batch) > 0 {
+            prev = append_audit(f, prev, batch)
+        }
+    }
+}
+
+// Adds whatever else is queued to the batch, without waiting
+func drain_audit(queue chan *AuditRecord, batch []*AuditRecord) ([]*AuditRecord) {
+    for len(batch) < audit_queue_sz {
+        select {
+        case rec := <-queue:
+            batch = append(batch, rec)
+        default:
+            return batch
+        }
+    }
+    return batch
+}
+
+// Writes the records chained to prev and syncs, returns the hash the chain
+// goes on from. The batch is synced before the chain moves on, a torn write
+// is caught by -audit-verify
+func append_audit(f *os.File, prev string, batch []*AuditRecord) (string) {
+    var buf []byte
+    next := prev
+    for _, rec := range batch {
+        rec.Prev = next
+        line, err := json.Marshal(rec)
+        if err != nil {
+            audit_log.errorf("Unable to encode audit record : %s", err.Error())
+            continue
+        }
+        buf = append(append(buf, line...), '\n')
+        next = audit_hash(line)
+    }
+    _, err := f.Write(buf)
+    if err == nil {
+        err = f.Sync()
+    }
+    if err != nil {
+        audit_log.errorf("Unable to write %d audit records : %s", len(batch), err.Error())
+        return prev
+    }
+    return next
+}
+
+// Counts a request refused by the rate limit, audited with the others from
+// the same source IP later on
+func audit_rate_limited(clientaddr *net.UDPAddr) {
+    auditlog.Lock()
+    defer auditlog.Unlock()
+    if auditlog.queue == nil {
+        return
+    }
+    auditlog.rate_limited[clientaddr.IP.String()]++
+}
+
+func take_rate_limited() (batch []*AuditRecord) {
+    auditlog.Lock()
+    defer auditlog.Unlock()
+    code := tftp.NotDefined
+    now := time.Now().UTC()
+    for ip, n := range auditlog.rate_limited {
+        batch = append(batch, &AuditRecord{ Time : now, Peer : ip, Op : "request", Outcome : "rate_limited", ErrorCode : &code, Error : "Rate limit exceeded", Count : n })
+    }
+    auditlog.rate_limited = make(map[string]int)
+    return batch
+}
+
+// Audits a request refused before any session started
+func audit_refused(datain *tftp.Message, clientaddr *net.UDPAddr, code uint16, msg string) {
+    op := "read"
+    if datain.Opcode == 1 {
+        op = "write"
+    }
+    write_audit(&AuditRecord{ Peer : clientaddr.String(), Op : op, Key : datain.Key, Outcome : "refused", ErrorCode : &code, Error : msg }, false)
+}
+
+// Audits an upload or a delete over the HTTP API, err is why it failed
+func audit_http(r *http.Request, op string, key string, file *File, err error) {
+    rec := &AuditRecord{ Peer : r.RemoteAddr, Op : op, Via : "http", Key : key, Outcome : "completed" }
+    if file != nil {
+        rec.Size = int64(file.sz)
+        rec.Sha256 = hex.EncodeToString(file.hash[:])
+    }
+    if err != nil {
+        rec.Outcome = "failed"
+        rec.Error = err.Error()
+    }
+    write_audit(rec, true)
+}
+
+func audit_http_refused(r *http.Request, op string, key string, msg string) {
+    write_audit(&AuditRecord{ Peer : r.RemoteAddr, Op : op, Via : "http", Key : key, Outcome : "refused", Error : msg }, false)
+}
+
+// Collects what a session learns about its transfer and audits it when the
+// session ends
+type TransferAudit struct {
+    rec AuditRecord
+    session *Session
+}
+
+func new_transfer_audit(op string, key string, clientaddr *net.UDPAddr) (a *TransferAudit) {
+    a = new(TransferAudit)
+    a.rec.Op = op
+    a.rec.Key = key
+    a.rec.Peer = clientaddr.String()
+    return a
+}
+
+func (a *TransferAudit) attach(session *Session) {
+    a.session = session
+    a.rec.Session = session.info.Id
+}
+
+func (a *TransferAudit) content(hash [sha256.Size]byte) {
+    a.rec.Sha256 = hex.EncodeToString(hash[:])
+}
+
+// The transfer picked up at offset where an earlier one left off, the size
+// audited is that of the file up to where this one got
+func (a *TransferAudit) resume(offset int) {
+    a.rec.Offset = int64(offset)
+}
+
+// Records why the transfer failed, with the code of the ERROR the peer sent
+// if it aborted
+func (a *TransferAudit) fail(err error) {
+    if pe, ok := err.(*PeerError); ok == true {
+        a.rec.ErrorCode = &pe.code
+    }
+    a.rec.Error = err.Error()
+}
+
+// Records the ERROR the session aborted the transfer with
+func (a *TransferAudit) abort(code uint16, msg string) {
+    a.rec.ErrorCode = &code
+    a.rec.Error = msg
+}
+
+func (a *TransferAudit) done(completed bool) {
+    if a.session != nil {
+        a.rec.Size = a.rec.Offset + a.session.snapshot().Bytes
+    }
+    a.rec.Outcome = "completed"
+    if completed == false {
+        a.rec.Outcome = "failed"
+    }
+    write_audit(&a.rec, true)
+}
+
+// Walks the hash chain of an audit log, returns the number of records or the
+// first line which does not chain
+func verify_audit(r io.Reader) (int, error) {
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024)
+    prev := audit_genesis
+    n := 0
+    for scanner.Scan() {
+        n++
+        var rec AuditRecord
+        if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+            return n - 1, fmt.Errorf("line %d : %s", n, err.Error())
+        }
+        if rec.Prev != prev {
+            return n - 1, fmt.Errorf("line %d : chain broken, prev=%s, expected %s", n, rec.Prev, prev)
+        }
+        prev = audit_hash(scanner.Bytes())
+    }
+    return n, scanner.Err()
+}
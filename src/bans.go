@@ -0,0 +1,221 @@
+package main
+
+import(
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// ---------------------------------
+// Automatic Temporary Bans
+// ---------------------------------
+// Offenses are counted per source IP over -ban-window. A source exceeding the
+// threshold of any kind is banned for -ban-duration : the control loop drops
+// everything it sends without an answer. Sessions already running are left
+// alone. Addresses in -ban-allow are never banned. Kinds of offenses :
+// - malformed        : undecodable packets
+// - unknown_tid      : packets sent to a session TID by someone else than its peer
+// - access_violation : requests denied by the access list or the filename
+//                      policy, not those refused by the server mode
+// - failed_session   : transfers abandoned by a peer, which stopped answering
+//                      after it had answered. Refusals and missing files
+//                      are not held against the peer
+var banMalformed = flag.Int("ban-malformed", 20, "malformed packets per window before a source is banned, 0 disables")
+var banUnknownTid = flag.Int("ban-unknown-tid", 20, "unknown TID packets per window before a source is banned, 0 disables")
+var banAccess = flag.Int("ban-access", 20, "access violations per window before a source is banned, 0 disables")
+var banFailed = flag.Int("ban-failed", 20, "transfers abandoned by the peer per window before a source is banned, 0 disables")
+var banWindow = flag.Duration("ban-window", time.Minute, "window over which offenses are counted")
+var banDuration = flag.Duration("ban-duration", 10 * time.Minute, "how long a source stays banned")
+var banAllow = flag.String("ban-allow", "127.0.0.0/8,::1/128", "comma separated CIDRs which are never banned")
+
+var bans_log = new_logger("BANS")
+
+var ban_thresholds = map[string]*int{
+    "malformed" : banMalformed,
+    "unknown_tid" : banUnknownTid,
+    "access_violation" : banAccess,
+    "failed_session" : banFailed,
+}
+
+type Offenses struct {
+    counts map[string]int
+    window_start time.Time
+}
+
+type Ban struct {
+    until time.Time
+    reason string
+}
+
+var bans = struct {
+    sync.Mutex
+    offenses map[string]*Offenses
+    banned map[string]*Ban
+    allow []*net.IPNet
+    last_prune time.Time
+} { offenses : make(map[string]*Offenses), banned : make(map[string]*Ban) }
+
+func init() {
+    admin_commands["bans"] = AdminCommand{ "bans", admin_bans }
+    admin_commands["ban"] = AdminCommand{ "ban <ip> [duration]", admin_ban }
+    admin_commands["unban"] = AdminCommand{ "unban <ip>", admin_unban }
+}
+
+func load_ban_allow(list string) (error) {
+    var allow []*net.IPNet
+    for _, cidr := range strings.Split(list, ",") {
+        cidr = strings.TrimSpace(cidr)
+        if cidr == "" {
+            continue
+        }
+        _, network, err := net.ParseCIDR(cidr)
+        if err != nil {
+            return fmt.Errorf("ban-allow : %s", err.Error())
+        }
+        allow = append(allow, network)
+    }
+
+    bans.Lock()
+    bans.allow = allow
+    bans.Unlock()
+    return nil
+}
+
+// Must be called with the bans lock held
+func ban_allowed(ip net.IP) (bool) {
+    for _, network := range bans.allow {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+func is_banned(ip net.IP) (bool) {
+    key := ip.String()
+
+    bans.Lock()
+    defer bans.Unlock()
+
+    ban, ok := bans.banned[key]
+    if ok == false {
+        return false
+    }
+    if time.Now().After(ban.until) {
+        bans_log.infof("Ban expired, src=%s", key)
+        delete(bans.banned, key)
+        return false
+    }
+    return true
+}
+
+func record_offense(ip net.IP, kind string) {
+    key := ip.String()
+    count("offense_" + kind)
+
+    bans.Lock()
+    defer bans.Unlock()
+
+    now := time.Now()
+    if now.Sub(bans.last_prune) > *banWindow {
+        for k, o := range bans.offenses {
+            if now.Sub(o.window_start) > *banWindow {
+                delete(bans.offenses, k)
+            }
+        }
+        bans.last_prune = now
+    }
+
+    o, ok := bans.offenses[key]
+    if ok == false || now.Sub(o.window_start) > *banWindow {
+        o = &Offenses{ counts : make(map[string]int), window_start : now }
+        bans.offenses[key] = o
+    }
+    o.counts[kind]++
+
+    threshold := *ban_thresholds[kind]
+    if threshold <= 0 || o.counts[kind] < threshold {
+        return
+    }
+    if ban_allowed(ip) {
+        return
+    }
+    if _, already := bans.banned[key]; already == true {
+        return
+    }
+
+    reason := fmt.Sprintf("%d %s in %s", o.counts[kind], kind, *banWindow)
+    bans.banned[key] = &Ban{ until : now.Add(*banDuration), reason : reason }
+    delete(bans.offenses, key)
+    count("bans")
+    bans_log.warnf("Banning src=%s for %s : %s", key, *banDuration, reason)
+}
+
+func admin_bans(args []string, w io.Writer) (error) {
+    bans.Lock()
+    defer bans.Unlock()
+
+    now := time.Now()
+    keys := make([]string, 0, len(bans.banned))
+    for k, ban := range bans.banned {
+        if now.Before(ban.until) {
+            keys = append(keys, k)
+        }
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        ban := bans.banned[k]
+        fmt.Fprintf(w, "%s until=%s remaining=%s reason=%q\n", k, ban.until.Format(time.RFC3339), ban.until.Sub(now).Truncate(time.Second), ban.reason)
+    }
+    return nil
+}
+
+func admin_ban(args []string, w io.Writer) (error) {
+    if len(args) == 0 {
+        return fmt.Errorf("usage : ban <ip> [duration]")
+    }
+    ip := net.ParseIP(args[0])
+    if ip == nil {
+        return fmt.Errorf("bad address %q", args[0])
+    }
+    duration := *banDuration
+    if len(args) > 1 {
+        d, err := time.ParseDuration(args[1])
+        if err != nil {
+            return err
+        }
+        duration = d
+    }
+
+    bans.Lock()
+    bans.banned[ip.String()] = &Ban{ until : time.Now().Add(duration), reason : "banned by admin" }
+    bans.Unlock()
+    bans_log.warnf("Banning src=%s for %s : banned by admin", ip.String(), duration)
+    return nil
+}
+
+func admin_unban(args []string, w io.Writer) (error) {
+    if len(args) == 0 {
+        return fmt.Errorf("usage : unban <ip>")
+    }
+    ip := net.ParseIP(args[0])
+    if ip == nil {
+        return fmt.Errorf("bad address %q", args[0])
+    }
+
+    bans.Lock()
+    defer bans.Unlock()
+
+    if _, ok := bans.banned[ip.String()]; ok == false {
+        return fmt.Errorf("%s is not banned", ip.String())
+    }
+    delete(bans.banned, ip.String())
+    delete(bans.offenses, ip.String())
+    bans_log.infof("Unbanned src=%s", ip.String())
+    return nil
+}
@@ -0,0 +1,445 @@
+package main
+
+import(
+    "bufio"
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash"
+    "io"
+    "io/fs"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+    "ttftp/tftp"
+)
+
+// ---------------------------------
+// Batch Transfers
+// ---------------------------------
+//   ttftp [flags] batch [client flags] [batch flags] get|put host[:port] manifest|dir
+//
+// Transfers many files, -parallel at a time. The files come from a manifest,
+// one file per line :
+//
+//   local-path remote-key [sha256]
+//
+// fields separated by blanks, blank lines and lines starting with # ignored.
+// Instead of a manifest both take a directory, an existing one or any path
+// ending with '/'. put uploads its regular files under -prefix with their
+// path relative to it as the key. get downloads the keys under -prefix into
+// it, with their path relative to the prefix, from the listing the server
+// serves as -index under the prefix ( see -index-name ), which gives their
+// SHA-256 as well. The expected SHA-256, when given, is checked against the bytes sent or received, and against the local
+// file before an upload. Every file gets up to -attempts tries, except when
+// the server refuses it ( file not found, access violation, ... ), the local
+// file is unusable or the content is not the expected one. A report line per
+// file and a summary are printed, -manifest-out writes a manifest of the
+// files transferred with their hashes, e.g. to check a later download. Exits
+// with exit_batch_failed when any transfer failed or mismatched
+const exit_batch_failed int = 4
+
+type BatchEntry struct {
+    local string
+    remote string
+    sha256 string
+}
+
+type BatchResult struct {
+    entry *BatchEntry
+    bytes int64
+    sha256 string
+    attempts int
+    elapsed time.Duration
+    err error
+}
+
+func run_batch(args []string) (int) {
+    c := new(tftp.Client)
+    fs, apply := client_flags("batch", c)
+    parallel := fs.Int("parallel", 4, "files transferred at the same time")
+    attempts := fs.Int("attempts", 3, "tries per file")
+    prefix := fs.String("prefix", "", "remote key prefix of the files of a directory")
+    index := fs.String("index", ".index", "name of the server's listing, for get of a directory")
+    manifest_out := fs.String("manifest-out", "", "file to write a manifest of the files transferred to")
+    if err := fs.Parse(args); err != nil {
+        return exit_usage
+    }
+    if err := apply(); err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        return exit_usage
+    }
+    if fs.NArg() != 3 || (fs.Arg(0) != "get" && fs.Arg(0) != "put") {
+        fs.Usage()
+        return exit_usage
+    }
+    if *parallel < 1 || *attempts < 1 {
+        fmt.Fprintf(os.Stderr, "Error: parallel and attempts must be positive\n")
+        return exit_usage
+    }
+    op := fs.Arg(0)
+    c, err := configure_client(c, fs.Arg(1))
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        return exit_usage
+    }
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+
+    var entries []*BatchEntry
+    fi, err := os.Stat(fs.Arg(2))
+    if (err == nil && fi.IsDir() == true) || strings.HasSuffix(fs.Arg(2), "/") == true {
+        if op == "get" {
+            entries, err = list_batch_remote(ctx, c, *prefix, *index, fs.Arg(2))
+            if err != nil {
+                return transfer_exit_code(err)
+            }
+        } else {
+            entries, err = walk_batch_dir(fs.Arg(2), *prefix)
+        }
+    } else {
+        entries, err = read_manifest(fs.Arg(2))
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        return exit_local
+    }
+
+    start := time.Now()
+    results := run_batch_transfers(ctx, c, op, entries, *parallel, *attempts)
+    failed := report_batch(os.Stdout, results, time.Since(start))
+
+    if *manifest_out != "" {
+        if err := write_manifest(*manifest_out, results); err != nil {
+            fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+            return exit_local
+        }
+    }
+    if ctx.Err() != nil {
+        return exit_interrupted
+    }
+    if failed > 0 {
+        return exit_batch_failed
+    }
+    return exit_ok
+}
+
+func read_manifest(filename string) (entries []*BatchEntry, err error) {
+    f, err := os.Open(filename)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    n := 0
+    for scanner.Scan() {
+        n++
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") == true {
+            continue
+        }
+        fields := strings.Fields(line)
+        if len(fields) < 2 || len(fields) > 3 {
+            return nil, fmt.Errorf("%s:%d : expected local-path remote-key [sha256]", filename, n)
+        }
+        e := &BatchEntry{ local : fields[0], remote : fields[1] }
+        if len(fields) == 3 {
+            if b, err := hex.DecodeString(fields[2]); err != nil || len(b) != sha256.Size {
+                return nil, fmt.Errorf("%s:%d : bad sha256 %q", filename, n, fields[2])
+            }
+            e.sha256 = strings.ToLower(fields[2])
+        }
+        entries = append(entries, e)
+    }
+    return entries, scanner.Err()
+}
+
+// Lists the regular files under dir, keyed by prefix and their slash
+// separated path relative to dir
+func walk_batch_dir(dir string, prefix string) (entries []*BatchEntry, err error) {
+    err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if d.Type().IsRegular() == false {
+            return nil
+        }
+        rel, err := filepath.Rel(dir, p)
+        if err != nil {
+            return err
+        }
+        entries = append(entries, &BatchEntry{ local : p, remote : prefix + filepath.ToSlash(rel) })
+        return nil
+    })
+    return entries, err
+}
+
+// Lists the keys under prefix from the listing the server serves as index
+// under it, as entries downloading them under dir. Keys whose path relative
+// to prefix would land outside dir are refused
+func list_batch_remote(ctx context.Context, c *tftp.Client, prefix string, index string, dir string) (entries []*BatchEntry, err error) {
+    if prefix != "" && strings.HasSuffix(prefix, "/") == false {
+        prefix += "/"
+    }
+    listing := new(bytes.Buffer)
+    if _, err := c.Get(ctx, prefix + index, listing); err != nil {
+        return nil, fmt.Errorf("listing %s : %w", prefix + index, err)
+    }
+    infos, err := parse_listing(listing.Bytes())
+    if err != nil {
+        return nil, fmt.Errorf("listing %s : %w", prefix + index, err)
+    }
+    for _, fi := range infos {
+        rel := strings.TrimPrefix(fi.Key, prefix)
+        if strings.HasPrefix(fi.Key, prefix) == false || filepath.IsLocal(filepath.FromSlash(rel)) == false {
+            return nil, fmt.Errorf("listing %s : key %q is not under the prefix", prefix + index, fi.Key)
+        }
+        entries = append(entries, &BatchEntry{ local : filepath.Join(dir, filepath.FromSlash(rel)), remote : fi.Key, sha256 : strings.ToLower(fi.Hash) })
+    }
+    return entries, nil
+}
+
+// Reads a listing in either of the server's formats ( -index-format ) :
+// a JSON array or lines of size, mtime, sha256 and key separated by tabs
+func parse_listing(b []byte) (infos []FileInfo, err error) {
+    if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '[' {
+        err = json.Unmarshal(trimmed, &infos)
+        return infos, err
+    }
+    for n, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+        if line == "" {
+            continue
+        }
+        fields := strings.SplitN(line, "\t", 4)
+        if len(fields) != 4 {
+            return nil, fmt.Errorf("line %d : expected size, mtime, sha256 and key", n + 1)
+        }
+        infos = append(infos, FileInfo{ Key : fields[3], Hash : fields[2] })
+    }
+    return infos, nil
+}
+
+// Runs the transfers with at most parallel at a time, results come back in
+// the order of entries
+func run_batch_transfers(ctx context.Context, c *tftp.Client, op string, entries []*BatchEntry, parallel int, attempts int) ([]*BatchResult) {
+    results := make([]*BatchResult, len(entries))
+    work := make(chan int)
+    var wg sync.WaitGroup
+    for i := 0; i < parallel; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for idx := range work {
+                results[idx] = batch_transfer(ctx, c, op, entries[idx], attempts)
+            }
+        }()
+    }
+    for idx := range entries {
+        work <- idx
+    }
+    close(work)
+    wg.Wait()
+    return results
+}
+
+// Transfers one file, trying again after failures which may not happen twice
+func batch_transfer(ctx context.Context, c *tftp.Client, op string, e *BatchEntry, attempts int) (res *BatchResult) {
+    res = &BatchResult{ entry : e }
+    start := time.Now()
+    for res.attempts < attempts {
+        if ctx.Err() != nil {
+            if res.err == nil {
+                res.err = ctx.Err()
+            }
+            break
+        }
+        if res.attempts > 0 {
+            client_log.infof("Retrying %s, Key=%s, attempt %d / %d : %s", op, e.remote, res.attempts + 1, attempts, res.err.Error())
+            select {
+            case <-time.After(time.Duration(res.attempts) * 500 * time.Millisecond):
+            case <-ctx.Done():
+                continue
+            }
+        }
+        res.attempts++
+        h := sha256.New()
+        if op == "get" {
+            res.bytes, res.err = batch_get(ctx, c, e, h)
+        } else {
+            res.bytes, res.err = batch_put(ctx, c, e, h)
+        }
+        if res.err == nil {
+            res.sha256 = hex.EncodeToString(h.Sum(nil))
+            break
+        }
+        if batch_retryable(res.err) == false {
+            break
+        }
+    }
+    res.elapsed = time.Since(start)
+    return res
+}
+
+// Refusals by the server, content other than expected and local errors
+// would fail the same way again
+func batch_retryable(err error) (bool) {
+    if errors.Is(err, tftp.ErrHashMismatch) == true {
+        return false
+    }
+    var se *tftp.ServerError
+    if errors.As(err, &se) == true {
+        return se.Code == tftp.NotDefined
+    }
+    if errors.Is(err, context.Canceled) == true {
+        return false
+    }
+    var pe *fs.PathError
+    return errors.As(err, &pe) == false
+}
+
+// Downloads to local.part, which only replaces local when the content has
+// the expected hash
+func batch_get(ctx context.Context, c *tftp.Client, e *BatchEntry, h hash.Hash) (n int64, err error) {
+    if dir := filepath.Dir(e.local); dir != "." {
+        if err := os.MkdirAll(dir, 0755); err != nil {
+            return 0, err
+        }
+    }
+    f, err := os.Create(e.local + ".part")
+    if err != nil {
+        return 0, err
+    }
+    n, err = c.Get(ctx, e.remote, io.MultiWriter(f, h))
+    f.Close()
+    if err == nil {
+        err = check_batch_hash(e, h)
+    }
+    if err == nil {
+        err = os.Rename(e.local + ".part", e.local)
+    }
+    if err != nil {
+        os.Remove(e.local + ".part")
+    }
+    return n, err
+}
+
+// Uploads local. With an expected hash the file is checked before anything
+// is sent, and the bytes sent are checked again before the last block goes
+// out : a file changing under the transfer aborts it rather than leave the
+// server with content other than expected
+func batch_put(ctx context.Context, c *tftp.Client, e *BatchEntry, h hash.Hash) (n int64, err error) {
+    f, err := os.Open(e.local)
+    if err != nil {
+        return 0, err
+    }
+    defer f.Close()
+    if e.sha256 != "" {
+        pre := sha256.New()
+        if _, err := io.Copy(pre, f); err != nil {
+            return 0, err
+        }
+        if err := check_batch_hash(e, pre); err != nil {
+            return 0, err
+        }
+        if _, err := f.Seek(0, io.SeekStart); err != nil {
+            return 0, err
+        }
+    }
+    fi, err := f.Stat()
+    if err != nil {
+        return 0, err
+    }
+    return c.Put(ctx, e.remote, &sized_reader{ &checked_reader{ f, h, e }, fi.Size() })
+}
+
+// Hashes what is read and checks it at the end, the error replaces io.EOF so
+// that Put aborts before the last block
+type checked_reader struct {
+    r io.Reader
+    h hash.Hash
+    e *BatchEntry
+}
+
+func (cr *checked_reader) Read(p []byte) (int, error) {
+    n, err := cr.r.Read(p)
+    cr.h.Write(p[0:n])
+    if err == io.EOF {
+        if cerr := check_batch_hash(cr.e, cr.h); cerr != nil {
+            return n, cerr
+        }
+    }
+    return n, err
+}
+
+func check_batch_hash(e *BatchEntry, h hash.Hash) (error) {
+    sum := hex.EncodeToString(h.Sum(nil))
+    if e.sha256 != "" && sum != e.sha256 {
+        return fmt.Errorf("%w : expected %s, got %s", tftp.ErrHashMismatch, e.sha256, sum)
+    }
+    return nil
+}
+
+// A reader which knows how much is left, so Put can still send tsize
+type sized_reader struct {
+    io.Reader
+    size int64
+}
+
+func (r *sized_reader) Len() (int) {
+    return int(r.size)
+}
+
+// Prints a line per file and the totals, returns the number of files which
+// were not transferred
+func report_batch(w io.Writer, results []*BatchResult, elapsed time.Duration) (failed int) {
+    var bytes int64
+    mismatched := 0
+    for _, res := range results {
+        status := "OK"
+        detail := ""
+        if errors.Is(res.err, tftp.ErrHashMismatch) == true {
+            status = "MISMATCH"
+            mismatched++
+        } else if res.err != nil {
+            status = "FAILED"
+        }
+        if res.err != nil {
+            failed++
+            detail = " : " + res.err.Error()
+        } else {
+            bytes += res.bytes
+        }
+        fmt.Fprintf(w, "%-8s %s %s bytes=%d attempts=%d time=%s%s\n", status, res.entry.local, res.entry.remote, res.bytes, res.attempts, res.elapsed.Round(time.Millisecond), detail)
+    }
+    fmt.Fprintf(w, "%d files : %d ok, %d failed, %d mismatched, %d bytes in %s [%.0f bit/s]\n",
+        len(results), len(results) - failed, failed - mismatched, mismatched, bytes, elapsed.Round(time.Millisecond), float64(bytes * 8) / elapsed.Seconds())
+    return failed
+}
+
+// Writes the files transferred as a manifest with their hashes
+func write_manifest(filename string, results []*BatchResult) (error) {
+    f, err := os.Create(filename)
+    if err != nil {
+        return err
+    }
+    w := bufio.NewWriter(f)
+    for _, res := range results {
+        if res.err == nil {
+            fmt.Fprintf(w, "%s %s %s\n", res.entry.local, res.entry.remote, res.sha256)
+        }
+    }
+    if err := w.Flush(); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
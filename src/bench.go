@@ -0,0 +1,400 @@
+package main
+
+import(
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math/rand"
+    "os"
+    "os/signal"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "ttftp/tftp"
+)
+
+// ---------------------------------
+// Load Generator
+// ---------------------------------
+//   ttftp [flags] bench [client flags] [bench flags] host[:port]
+//
+// Runs -readers and -writers concurrent loops against a server for
+// -duration, each starting a new transfer as soon as the last one is done.
+// Writers pick a size from -sizes, a weighted list of sizes or size ranges
+// ( e.g. 0-4k:3,64k:2,1m-4m:1 picks a size up to 4k half of the time ), and
+// overwrite one of the keys written so far with probability -reuse, a new
+// key under -prefix otherwise. Readers pick any key written so far, -seed-files
+// are written before the clock starts so there is something to read. Reads
+// are checked against the hashes written to the key. The report gives per
+// operation the transfers, failures, throughput and latency percentiles and
+// the packets retransmitted, -json prints it as JSON to compare runs
+type BenchSize struct {
+    lo int
+    hi int
+    weight int
+}
+
+type BenchOpReport struct {
+    Transfers int `json:"transfers"`
+    Failures int `json:"failures"`
+    Mismatches int `json:"mismatches"`
+    Bytes int64 `json:"bytes"`
+    MBps float64 `json:"mb_per_sec"`
+    TransfersPerSec float64 `json:"transfers_per_sec"`
+    LatencyMs map[string]float64 `json:"latency_ms"`
+    latencies []time.Duration
+    errors map[string]int
+}
+
+type BenchReport struct {
+    Duration float64 `json:"duration_sec"`
+    Readers int `json:"readers"`
+    Writers int `json:"writers"`
+    Read *BenchOpReport `json:"read"`
+    Write *BenchOpReport `json:"write"`
+    Retransmits int64 `json:"retransmits"`
+}
+
+// Keys written so far, in a slice to pick from and a set to find them, and
+// every hash written to each of them
+type BenchKeys struct {
+    sync.Mutex
+    keys []string
+    known map[string]bool
+    hashes map[string]map[string]bool
+    next int
+}
+
+func run_bench(args []string) (int) {
+    c := new(tftp.Client)
+    fs, apply := client_flags("bench", c)
+    readers := fs.Int("readers", 4, "concurrent readers")
+    writers := fs.Int("writers", 2, "concurrent writers")
+    duration := fs.Duration("duration", 10 * time.Second, "how long to run")
+    sizes_spec := fs.String("sizes", "512:1,8k:2,64k:2,1m:1", "weighted sizes or size ranges of the files written, size[-size]:weight,...")
+    reuse := fs.Float64("reuse", 0.5, "probability a write overwrites an existing key")
+    prefix := fs.String("prefix", "bench/", "prefix of the keys written")
+    seed_files := fs.Int("seed-files", 8, "files written before the clock starts")
+    seed := fs.Int64("seed", 0, "random seed, 0 picks one")
+    as_json := fs.Bool("json", false, "print the report as JSON")
+    if err := fs.Parse(args); err != nil {
+        return exit_usage
+    }
+    if err := apply(); err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        return exit_usage
+    }
+    if fs.NArg() != 1 {
+        fs.Usage()
+        return exit_usage
+    }
+    sizes, err := parse_bench_sizes(*sizes_spec)
+    if err == nil && (*readers < 0 || *writers < 0 || *readers + *writers == 0) {
+        err = fmt.Errorf("at least one reader or writer is needed")
+    }
+    if err == nil && (*reuse < 0 || *reuse > 1) {
+        err = fmt.Errorf("reuse must be between 0 and 1")
+    }
+    if err == nil && *readers > 0 && *seed_files < 1 {
+        err = fmt.Errorf("readers need seed files")
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        return exit_usage
+    }
+    c, err = configure_client(c, fs.Arg(0))
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        return exit_usage
+    }
+    if *seed == 0 {
+        *seed = time.Now().UnixNano()
+    }
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+    keys := &BenchKeys{ known : make(map[string]bool), hashes : make(map[string]map[string]bool) }
+    rnd := rand.New(rand.NewSource(*seed))
+    for i := 0; i < *seed_files; i++ {
+        key, _ := keys.pick(rnd, 0, *prefix)
+        if _, _, err := bench_write(ctx, c, rnd, keys, key, sizes); err != nil {
+            fmt.Fprintf(os.Stderr, "Error: seeding %s : %s\n", key, err.Error())
+            return transfer_exit_code(err)
+        }
+    }
+
+    report := &BenchReport{ Readers : *readers, Writers : *writers, Read : new_bench_op_report(), Write : new_bench_op_report() }
+    retransmits := c.Retransmits()
+    run_ctx, cancel := context.WithTimeout(ctx, *duration)
+    defer cancel()
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    start := time.Now()
+    for i := 0; i < *readers + *writers; i++ {
+        wg.Add(1)
+        write := i < *writers
+        r := rand.New(rand.NewSource(*seed + int64(i) + 1))
+        go func() {
+            defer wg.Done()
+            for run_ctx.Err() == nil {
+                var n int64
+                var err error
+                t0 := time.Now()
+                op := report.Read
+                if write == true {
+                    op = report.Write
+                    key, _ := keys.pick(r, *reuse, *prefix)
+                    n, _, err = bench_write(run_ctx, c, r, keys, key, sizes)
+                } else {
+                    _, key := keys.pick(r, 1, *prefix)
+                    n, err = bench_read(run_ctx, c, keys, key)
+                }
+                elapsed := time.Since(t0)
+                // transfers cut short by the end of the run do not count
+                if err != nil && run_ctx.Err() != nil {
+                    break
+                }
+                mu.Lock()
+                op.add(n, elapsed, err)
+                mu.Unlock()
+            }
+        }()
+    }
+    wg.Wait()
+    report.Duration = time.Since(start).Seconds()
+    report.Retransmits = c.Retransmits() - retransmits
+    report.Read.finish(report.Duration)
+    report.Write.finish(report.Duration)
+
+    if *as_json == true {
+        enc := json.NewEncoder(os.Stdout)
+        enc.SetIndent("", "  ")
+        enc.Encode(report)
+    } else {
+        print_bench_report(os.Stdout, report)
+    }
+    if ctx.Err() != nil {
+        return exit_interrupted
+    }
+    if report.Read.Failures + report.Write.Failures > 0 {
+        return exit_batch_failed
+    }
+    return exit_ok
+}
+
+// Parses size[-size]:weight,... sizes take a k, m or g suffix
+func parse_bench_sizes(spec string) (sizes []BenchSize, err error) {
+    for _, item := range strings.Split(spec, ",") {
+        item = strings.TrimSpace(item)
+        weight := 1
+        if i := strings.LastIndex(item, ":"); i >= 0 {
+            weight, err = strconv.Atoi(item[i + 1:])
+            if err != nil || weight < 1 {
+                return nil, fmt.Errorf("bad weight in %q", item)
+            }
+            item = item[0:i]
+        }
+        lo_s, hi_s := item, item
+        if i := strings.Index(item, "-"); i >= 0 {
+            lo_s, hi_s = item[0:i], item[i + 1:]
+        }
+        lo, err := parse_size(lo_s)
+        if err != nil {
+            return nil, err
+        }
+        hi, err := parse_size(hi_s)
+        if err != nil {
+            return nil, err
+        }
+        if hi < lo {
+            return nil, fmt.Errorf("bad size range %q", item)
+        }
+        sizes = append(sizes, BenchSize{ lo, hi, weight })
+    }
+    return sizes, nil
+}
+
+func parse_size(s string) (int, error) {
+    mult := 1
+    lower := strings.ToLower(s)
+    if strings.HasSuffix(lower, "k") {
+        mult = 1024
+    } else if strings.HasSuffix(lower, "m") {
+        mult = 1024 * 1024
+    } else if strings.HasSuffix(lower, "g") {
+        mult = 1024 * 1024 * 1024
+    }
+    if mult > 1 {
+        lower = lower[0:len(lower) - 1]
+    }
+    n, err := strconv.Atoi(lower)
+    if err != nil || n < 0 {
+        return 0, fmt.Errorf("bad size %q", s)
+    }
+    return n * mult, nil
+}
+
+func pick_size(r *rand.Rand, sizes []BenchSize) (int) {
+    total := 0
+    for _, s := range sizes {
+        total += s.weight
+    }
+    n := r.Intn(total)
+    for _, s := range sizes {
+        if n < s.weight {
+            return s.lo + r.Intn(s.hi - s.lo + 1)
+        }
+        n -= s.weight
+    }
+    return 0
+}
+
+// Picks a key to write, one written before with probability reuse and a new
+// one otherwise, and a key to read among those written
+func (k *BenchKeys) pick(r *rand.Rand, reuse float64, prefix string) (write string, read string) {
+    k.Lock()
+    defer k.Unlock()
+    if len(k.keys) > 0 {
+        read = k.keys[r.Intn(len(k.keys))]
+    }
+    if len(k.keys) > 0 && r.Float64() < reuse {
+        return read, read
+    }
+    k.next++
+    return fmt.Sprintf("%s%d", prefix, k.next), read
+}
+
+// Registers a hash about to be written to key, readers may see it as soon as
+// the server has it
+func (k *BenchKeys) writing(key string, sum string) {
+    k.Lock()
+    defer k.Unlock()
+    if _, ok := k.hashes[key]; ok == false {
+        k.hashes[key] = make(map[string]bool)
+    }
+    k.hashes[key][sum] = true
+}
+
+// The key was written, readers may pick it
+func (k *BenchKeys) written(key string) {
+    k.Lock()
+    defer k.Unlock()
+    if k.known[key] == true {
+        return
+    }
+    k.known[key] = true
+    k.keys = append(k.keys, key)
+}
+
+func (k *BenchKeys) valid(key string, sum string) (bool) {
+    k.Lock()
+    defer k.Unlock()
+    return k.hashes[key][sum]
+}
+
+func bench_write(ctx context.Context, c *tftp.Client, r *rand.Rand, keys *BenchKeys, key string, sizes []BenchSize) (n int64, sum string, err error) {
+    content := make([]byte, pick_size(r, sizes))
+    r.Read(content)
+    h := sha256.Sum256(content)
+    sum = hex.EncodeToString(h[:])
+    keys.writing(key, sum)
+    n, err = c.Put(ctx, key, bytes.NewReader(content))
+    if err == nil {
+        keys.written(key)
+    }
+    return n, sum, err
+}
+
+func bench_read(ctx context.Context, c *tftp.Client, keys *BenchKeys, key string) (n int64, err error) {
+    h := sha256.New()
+    n, err = c.Get(ctx, key, h)
+    if err != nil {
+        return n, err
+    }
+    if sum := hex.EncodeToString(h.Sum(nil)); keys.valid(key, sum) == false {
+        return n, fmt.Errorf("%w : read %s from %s", tftp.ErrHashMismatch, sum, key)
+    }
+    return n, nil
+}
+
+func new_bench_op_report() (op *BenchOpReport) {
+    op = new(BenchOpReport)
+    op.errors = make(map[string]int)
+    return op
+}
+
+func (op *BenchOpReport) add(n int64, elapsed time.Duration, err error) {
+    op.Transfers++
+    if err != nil {
+        op.Failures++
+        if errors.Is(err, tftp.ErrHashMismatch) == true {
+            op.Mismatches++
+        }
+        op.errors[bench_error_class(err)]++
+        return
+    }
+    op.Bytes += n
+    op.latencies = append(op.latencies, elapsed)
+}
+
+// Groups errors without the details which differ from one to the next
+func bench_error_class(err error) (string) {
+    var se *tftp.ServerError
+    if errors.As(err, &se) == true {
+        return se.Error()
+    }
+    if errors.Is(err, tftp.ErrTimeout) == true {
+        return tftp.ErrTimeout.Error()
+    }
+    if errors.Is(err, tftp.ErrHashMismatch) == true {
+        return tftp.ErrHashMismatch.Error()
+    }
+    return err.Error()
+}
+
+func (op *BenchOpReport) finish(secs float64) {
+    sort.Slice(op.latencies, func(i, j int) bool { return op.latencies[i] < op.latencies[j] })
+    op.LatencyMs = make(map[string]float64)
+    if len(op.latencies) > 0 {
+        for _, p := range []int{ 50, 90, 99 } {
+            d := op.latencies[(len(op.latencies) - 1) * p / 100]
+            op.LatencyMs["p" + strconv.Itoa(p)] = float64(d.Microseconds()) / 1000
+        }
+        op.LatencyMs["max"] = float64(op.latencies[len(op.latencies) - 1].Microseconds()) / 1000
+    }
+    if secs > 0 {
+        op.MBps = float64(op.Bytes) / secs / (1024 * 1024)
+        op.TransfersPerSec = float64(op.Transfers - op.Failures) / secs
+    }
+}
+
+func print_bench_report(w io.Writer, report *BenchReport) {
+    fmt.Fprintf(w, "%d readers, %d writers, %.1f seconds, %d retransmits\n", report.Readers, report.Writers, report.Duration, report.Retransmits)
+    for _, name := range []string{ "read", "write" } {
+        op := report.Read
+        if name == "write" {
+            op = report.Write
+        }
+        fmt.Fprintf(w, "%-5s : %d transfers, %d failed ( %d mismatched ), %d bytes, %.2f MB/s, %.1f transfers/s\n",
+            name, op.Transfers, op.Failures, op.Mismatches, op.Bytes, op.MBps, op.TransfersPerSec)
+        if len(op.latencies) > 0 {
+            fmt.Fprintf(w, "        latency ms : p50=%.1f p90=%.1f p99=%.1f max=%.1f\n",
+                op.LatencyMs["p50"], op.LatencyMs["p90"], op.LatencyMs["p99"], op.LatencyMs["max"])
+        }
+        classes := make([]string, 0, len(op.errors))
+        for class := range op.errors {
+            classes = append(classes, class)
+        }
+        sort.Strings(classes)
+        for _, class := range classes {
+            fmt.Fprintf(w, "        %d x %s\n", op.errors[class], class)
+        }
+    }
+}
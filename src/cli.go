@@ -0,0 +1,358 @@
+package main
+
+import(
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "os/signal"
+    "path"
+    "path/filepath"
+    "time"
+    "ttftp/tftp"
+)
+
+// ---------------------------------
+// Client Commands
+// ---------------------------------
+//   ttftp [flags] get [client flags] host[:port] remote [local]
+//   ttftp [flags] put [client flags] local host[:port] [remote]
+//
+// local "-" is stdout / stdin, a missing local or remote is the base name of
+// the other one. The port defaults to 69. Exit codes :
+// - 0       : transfer completed
+// - 1       : local error, e.g. the local file could not be opened
+// - 2       : bad usage
+// - 3       : network error or the server stopped answering
+// - 5       : the file received does not have the SHA-256 of the server's
+// - 10 + n  : the server aborted with ERROR code n of RFC 1350 / 2347 ( 0-8 )
+// - 19      : the server aborted with any other ERROR code
+// - 130     : interrupted, the server is told with an ERROR
+const(
+    exit_ok int = 0
+    exit_local int = 1
+    exit_usage int = 2
+    exit_network int = 3
+    exit_mismatch int = 5
+    exit_server_error int = 10
+    exit_server_error_other int = 19
+    exit_interrupted int = 130
+)
+
+type ClientCommand struct {
+    usage string
+    run func(args []string) int
+}
+
+var client_commands = map[string]*ClientCommand{}
+
+func init() {
+    client_commands["get"] = &ClientCommand{ "get [client flags] host[:port] remote [local]", run_get }
+    client_commands["put"] = &ClientCommand{ "put [client flags] local host[:port] [remote]", run_put }
+    client_commands["batch"] = &ClientCommand{ "batch [client flags] [batch flags] get|put host[:port] manifest|dir", run_batch }
+    client_commands["bench"] = &ClientCommand{ "bench [client flags] [bench flags] host[:port]", run_bench }
+    client_commands["shell"] = &ClientCommand{ "shell [client flags] [-history file] [host[:port]]", run_shell }
+}
+
+// Runs the client command named by args[0], returns the exit code
+func run_client_command(args []string) (int) {
+    cmd, ok := client_commands[args[0]]
+    if ok == false {
+        fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+        return exit_usage
+    }
+    return cmd.run(args[1:])
+}
+
+var client_log = new_logger("CLIENT")
+
+// Returns a client for server, host[:port], which logs to CLIENT
+func new_client(server string) (*tftp.Client, error) {
+    c, err := tftp.NewClient(server)
+    if err != nil {
+        return nil, err
+    }
+    c.Logf = client_logf
+    return c, nil
+}
+
+// The lines of tftp clients, packets go through payload like the server's
+func client_logf(level int, format string, v ...interface{}) {
+    for i, arg := range v {
+        if b, ok := arg.([]byte); ok == true {
+            v[i] = payload(b)
+        }
+    }
+    client_log.logf(level, format, v...)
+}
+
+// Flags shared by the client commands, they configure c once parsed
+func client_flags(name string, c *tftp.Client) (fs *flag.FlagSet, apply func() error) {
+    fs = flag.NewFlagSet(name, flag.ContinueOnError)
+    mode := fs.String("mode", "octet", "transfer mode : octet | netascii")
+    blksize := fs.Int("blksize", tftp.BlockSize, "block size to negotiate ( RFC 2348 )")
+    windowsize := fs.Int("windowsize", 1, "blocks per ACK to negotiate ( RFC 7440 )")
+    timeout := fs.Duration("timeout", time.Second, "retransmission timeout, also sent to the server when set")
+    retries := fs.Int("retries", 5, "retransmissions in a row before giving up")
+    impair := fs.String("impair", "", "impair the packets sent, e.g. drop=0.2,dup=0.05,delay=10ms,seed=1 ( testing only )")
+    fs.Usage = func() {
+        fmt.Fprintf(os.Stderr, "usage : ttftp %s\n", client_commands[name].usage)
+        fs.PrintDefaults()
+    }
+
+    apply = func() error {
+        if *mode != "octet" && *mode != "netascii" {
+            return fmt.Errorf("unknown mode %q", *mode)
+        }
+        if *blksize < 8 || *blksize > tftp.MaxBlksize {
+            return fmt.Errorf("blksize must be between 8 and %d", tftp.MaxBlksize)
+        }
+        if *windowsize < 1 || *windowsize > 65535 {
+            return fmt.Errorf("windowsize must be between 1 and 65535")
+        }
+        if *timeout <= 0 || *retries < 0 {
+            return fmt.Errorf("timeout and retries must be positive")
+        }
+        imp, err := parse_impairment(*impair)
+        if err != nil {
+            return err
+        }
+        c.Mode = *mode
+        c.Blksize = *blksize
+        c.Windowsize = *windowsize
+        c.Timeout = *timeout
+        c.Retries = *retries
+        c.Wrap = impair_client(imp)
+        fs.Visit(func(f *flag.Flag) {
+            if f.Name == "timeout" {
+                c.SendTimeout = true
+            }
+        })
+        return nil
+    }
+    return fs, apply
+}
+
+// Returns a client for server configured as the flags set template
+func configure_client(template *tftp.Client, server string) (*tftp.Client, error) {
+    c, err := new_client(server)
+    if err != nil {
+        return nil, err
+    }
+    c.Mode = template.Mode
+    c.Blksize = template.Blksize
+    c.Windowsize = template.Windowsize
+    c.Timeout = template.Timeout
+    c.SendTimeout = template.SendTimeout
+    c.Retries = template.Retries
+    c.Trace = template.Trace
+    c.Wrap = template.Wrap
+    return c, nil
+}
+
+// Maps the error of a transfer to an exit code
+func transfer_exit_code(err error) (int) {
+    if err == nil {
+        return exit_ok
+    }
+    fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+    if errors.Is(err, context.Canceled) == true {
+        return exit_interrupted
+    }
+    var se *tftp.ServerError
+    if errors.As(err, &se) == true {
+        if se.Code > tftp.BadOptions {
+            return exit_server_error_other
+        }
+        return exit_server_error + int(se.Code)
+    }
+    if errors.Is(err, tftp.ErrHashMismatch) == true {
+        return exit_mismatch
+    }
+    if _, ok := err.(*os.PathError); ok == true {
+        return exit_local
+    }
+    if _, ok := err.(*os.LinkError); ok == true {
+        return exit_local
+    }
+    return exit_network
+}
+
+func run_get(args []string) (int) {
+    c := new(tftp.Client)
+    fs, apply := client_flags("get", c)
+    resume := fs.Bool("resume", false, "continue from local.part left by an interrupted download and check the SHA-256")
+    if err := fs.Parse(args); err != nil {
+        return exit_usage
+    }
+    if err := apply(); err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        return exit_usage
+    }
+    if fs.NArg() < 2 || fs.NArg() > 3 {
+        fs.Usage()
+        return exit_usage
+    }
+    c, err := configure_client(c, fs.Arg(0))
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        return exit_usage
+    }
+    remote := fs.Arg(1)
+    local := path.Base(remote)
+    if fs.NArg() == 3 {
+        local = fs.Arg(2)
+    }
+    if *resume == true && local == "-" {
+        fmt.Fprintf(os.Stderr, "Error: -resume needs a local file\n")
+        return exit_usage
+    }
+
+    start := time.Now()
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+    var n int64
+    if *resume == true {
+        n, err = resume_file(ctx, c, remote, local)
+    } else {
+        n, err = get_file(ctx, c, remote, local)
+    }
+    if err == nil {
+        client_log.infof("Received %d bytes in %s, Key=%s", n, time.Since(start), remote)
+    }
+    return transfer_exit_code(err)
+}
+
+func run_put(args []string) (int) {
+    c := new(tftp.Client)
+    fs, apply := client_flags("put", c)
+    resume := fs.Bool("resume", false, "let the server keep a failed upload and continue it on the next run ( needs -upload-grace on the server )")
+    if err := fs.Parse(args); err != nil {
+        return exit_usage
+    }
+    if err := apply(); err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        return exit_usage
+    }
+    if fs.NArg() < 2 || fs.NArg() > 3 {
+        fs.Usage()
+        return exit_usage
+    }
+    local := fs.Arg(0)
+    c, err := configure_client(c, fs.Arg(1))
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        return exit_usage
+    }
+    remote := path.Base(local)
+    if fs.NArg() == 3 {
+        remote = fs.Arg(2)
+    } else if local == "-" {
+        fmt.Fprintf(os.Stderr, "Error: the remote name is required when reading stdin\n")
+        return exit_usage
+    }
+
+    if *resume == true && local == "-" {
+        fmt.Fprintf(os.Stderr, "Error: -resume needs a local file\n")
+        return exit_usage
+    }
+
+    start := time.Now()
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+    var n int64
+    if *resume == true {
+        n, err = resume_put_file(ctx, c, local, remote)
+    } else {
+        n, err = put_file(ctx, c, local, remote)
+    }
+    if err == nil {
+        client_log.infof("Sent %d bytes in %s, Key=%s", n, time.Since(start), remote)
+    }
+    return transfer_exit_code(err)
+}
+
+// Downloads remote to local, "-" is stdout. Files are written to local.part
+// first and renamed once complete, a failed transfer never clobbers one
+func get_file(ctx context.Context, c *tftp.Client, remote string, local string) (n int64, err error) {
+    if local == "-" {
+        return c.Get(ctx, remote, os.Stdout)
+    }
+    f, err := os.Create(local + ".part")
+    if err != nil {
+        return 0, err
+    }
+    n, err = c.Get(ctx, remote, f)
+    f.Close()
+    if err == nil {
+        err = os.Rename(local + ".part", local)
+    }
+    if err != nil {
+        os.Remove(local + ".part")
+    }
+    return n, err
+}
+
+// Like get_file but local.part is kept when the transfer fails, and picked
+// up where it ends the next time. A part which does not add up to the file of
+// the server is dropped
+func resume_file(ctx context.Context, c *tftp.Client, remote string, local string) (n int64, err error) {
+    f, err := os.OpenFile(local + ".part", os.O_RDWR | os.O_CREATE, 0644)
+    if err != nil {
+        return 0, err
+    }
+    n, err = c.Resume(ctx, remote, f)
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        return n, os.Rename(local + ".part", local)
+    }
+    if errors.Is(err, tftp.ErrHashMismatch) == true {
+        os.Remove(local + ".part")
+    } else if n > 0 {
+        client_log.warnf("Kept %d bytes in %s.part, run again with -resume to continue", n, local)
+    }
+    return n, err
+}
+
+// Uploads local to remote, "-" is stdin
+func put_file(ctx context.Context, c *tftp.Client, local string, remote string) (n int64, err error) {
+    var r io.Reader = os.Stdin
+    if local != "-" {
+        f, err := os.Open(local)
+        if err != nil {
+            return 0, err
+        }
+        defer f.Close()
+        r = f
+    }
+    return c.Put(ctx, remote, r)
+}
+
+// Uploads local to remote under a token which stays the same from run to
+// run as long as the file does not change, so the server can hand back what
+// a failed run left
+func resume_put_file(ctx context.Context, c *tftp.Client, local string, remote string) (n int64, err error) {
+    f, err := os.Open(local)
+    if err != nil {
+        return 0, err
+    }
+    defer f.Close()
+    fi, err := f.Stat()
+    if err != nil {
+        return 0, err
+    }
+    abs, err := filepath.Abs(local)
+    if err != nil {
+        return 0, err
+    }
+    h := sha256.New()
+    fmt.Fprintf(h, "%s\x00%s\x00%s\x00%d\x00%d", c.Addr.String(), remote, abs, fi.Size(), fi.ModTime().UnixNano())
+    token := hex.EncodeToString(h.Sum(nil))[0:32]
+    return c.ResumePut(ctx, remote, f, token)
+}
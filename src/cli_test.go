@@ -0,0 +1,29 @@
+package main
+
+import(
+    "context"
+    "fmt"
+    "testing"
+    "ttftp/tftp"
+)
+
+func TestTransferExitCode(t *testing.T) {
+    tests := []struct {
+        err error
+        want int
+    }{
+        { nil, exit_ok },
+        { context.Canceled, exit_interrupted },
+        { &tftp.ServerError{ Code : tftp.FileNotFound }, 11 },
+        { &tftp.ServerError{ Code : tftp.BadOptions }, 18 },
+        { &tftp.ServerError{ Code : 9 }, exit_server_error_other },
+        { &tftp.ServerError{ Code : 65535 }, exit_server_error_other },
+        { fmt.Errorf("%w : expected a, got b", tftp.ErrHashMismatch), exit_mismatch },
+        { fmt.Errorf("%w waiting", tftp.ErrTimeout), exit_network },
+    }
+    for _, tt := range tests {
+        if got := transfer_exit_code(tt.err); got != tt.want {
+            t.Errorf("%v : got exit code %d, want %d", tt.err, got, tt.want)
+        }
+    }
+}
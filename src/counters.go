@@ -0,0 +1,56 @@
+package main
+
+import(
+    "fmt"
+    "io"
+    "sort"
+    "sync"
+)
+
+// ---------------------------------
+// Counters
+// ---------------------------------
+// Named event counters bumped by the control loop and the sessions, they can
+// be read back through the admin control channel ( "counters" )
+var counters = struct {
+    sync.Mutex
+    c map[string]int64
+} { c : make(map[string]int64) }
+
+func count(name string) {
+    count_add(name, 1)
+}
+
+func count_add(name string, delta int64) {
+    counters.Lock()
+    counters.c[name] += delta
+    counters.Unlock()
+}
+
+func counter_snapshot() (snapshot map[string]int64) {
+    counters.Lock()
+    defer counters.Unlock()
+
+    snapshot = make(map[string]int64, len(counters.c))
+    for name, v := range counters.c {
+        snapshot[name] = v
+    }
+    return snapshot
+}
+
+func init() {
+    admin_commands["counters"] = AdminCommand{ "counters", admin_counters }
+}
+
+func admin_counters(args []string, w io.Writer) (error) {
+    snapshot := counter_snapshot()
+    names := make([]string, 0, len(snapshot))
+    for name := range snapshot {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        fmt.Fprintf(w, "%s %d\n", name, snapshot[name])
+    }
+    return nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import(
+    "bytes"
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "net"
+    "strconv"
+    "time"
+    "ttftp/tftp"
+)
+
+// ---------------------------------
+// Session Endpoint
+// ---------------------------------
+// The server side of a session : its TID socket, the peer it talks to and the
+// last packets sent, which are retransmitted whenever the peer stays silent
+// for a retransmission timeout. Only packets coming from the peer's exact
+// address and port are considered. Without options a session moves one
+// tftp.BlockSize block at a time, peers may negotiate larger blocks
+// ( blksize ) and several blocks per ACK ( windowsize ) up to -max-blksize /
+// -max-windowsize
+var rexmtTimeout = flag.Duration("rexmt", time.Second, "retransmission timeout, peers may negotiate their own with the timeout option")
+var maxRetries = flag.Int("retries", 5, "retransmissions of the same packet before a session is aborted")
+var maxBlksize = flag.Int("max-blksize", tftp.MaxBlksize, "largest block size a peer may negotiate")
+var maxWindowsize = flag.Int("max-windowsize", 64, "largest number of blocks per window a peer may negotiate")
+
+type Endpoint struct {
+    conn net.PacketConn
+    addr *net.UDPAddr
+    peer *net.UDPAddr
+    log *Logger
+    guard PeerGuard
+    rexmt time.Duration
+    blksize int
+    windowsize int
+    offset int
+    last [][]byte
+    last_msg string
+    last_heard time.Time
+    buffer []byte
+    session *Session
+}
+
+// The peer aborted the session with an ERROR
+type PeerError struct {
+    code uint16
+    msg string
+}
+
+func (err *PeerError) Error() (string) {
+    return fmt.Sprintf("peer aborted the transfer : Code=%d Msg=%s", err.code, err.msg)
+}
+
+func new_endpoint(conn net.PacketConn, peer *net.UDPAddr, log *Logger, session *Session) (e *Endpoint) {
+    e = new(Endpoint)
+    e.session = session
+    e.conn = conn
+    e.addr = conn.LocalAddr().(*net.UDPAddr)
+    e.peer = peer
+    e.log = log
+    e.guard.ip = peer.IP.String()
+    e.rexmt = *rexmtTimeout
+    e.blksize = tftp.BlockSize
+    e.windowsize = 1
+    e.last_heard = time.Now()
+    return e
+}
+
+// Sends a message and keeps it around for retransmission
+func (e *Endpoint) send(m *tftp.Message) (error) {
+    return e.send_window([]*tftp.Message{ m })
+}
+
+// Sends messages back to back, all of them are retransmitted on timeouts
+func (e *Endpoint) send_window(window []*tftp.Message) (error) {
+    e.last = e.last[0:0]
+    for _, m := range window {
+        e.last = append(e.last, tftp.Encode(m).Bytes())
+    }
+    e.last_msg = window[0].String()
+    if len(window) > 1 {
+        e.last_msg = fmt.Sprintf("%s and %d more", e.last_msg, len(window) - 1)
+    }
+    return e.resend()
+}
+
+func (e *Endpoint) resend() (error) {
+    for _, packet := range e.last {
+        if err := e.write(packet, e.last_msg); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Sends an ERROR, best effort and never retransmitted
+func (e *Endpoint) send_error(code uint16, msg string) {
+    er := tftp.NewError(code, msg)
+    metric_errors.inc(strconv.Itoa(int(code)), "sent")
+    err := e.write(tftp.Encode(er).Bytes(), er.String())
+    if err != nil {
+        e.log.warnf("<send> : failed to send %s : %s", er.String(), err.Error())
+    }
+}
+
+func (e *Endpoint) write(packet []byte, desc string) (error) {
+    if err := e.guard.may_send(len(packet)); err != nil {
+        return fmt.Errorf("not sending to %s : %s", e.peer.String(), err.Error())
+    }
+    capture_packet(e.addr, e.peer, false, e.session.info.Key, packet)
+    n, err := e.conn.WriteTo(packet, e.peer)
+    if err != nil {
+        return err
+    }
+    metric_bytes_sent.add(float64(n), e.session.info.Type)
+    e.log.debugf("<send> : message-out=%s, bytes=%d, src=%s, dst=%s", desc, n, e.addr.String(), e.peer.String())
+    return nil
+}
+
+// Reads the next packet from the peer, ignoring packets from anyone else and
+// malformed ones. Returns a timeout error once the deadline passes
+func (e *Endpoint) read(deadline time.Time) (m *tftp.Message, err error) {
+    // one spare byte tells DATA larger than the block size apart
+    sz := tftp.DataHeaderBytes + e.blksize + 1
+    if len(e.buffer) != sz {
+        e.buffer = make([]byte, sz)
+    }
+    buffer := e.buffer
+    for {
+        e.conn.SetReadDeadline(deadline)
+        n, src, err := read_udp(e.conn, buffer)
+        if err != nil {
+            return nil, err
+        }
+        e.log.packetf("<read> : data=%s, bytes=%d, src=%s", payload(buffer[0:n]), n, src.String())
+        capture_packet(e.addr, src, true, e.session.info.Key, buffer[0:n])
+        metric_bytes_received.add(float64(n), e.session.info.Type)
+
+        if src.Port != e.peer.Port || src.IP.Equal(e.peer.IP) == false {
+            e.log.warnf("Ignoring packet from unknown TID, src=%s", src.String())
+            e.reject_unknown_tid(src)
+            continue
+        }
+
+        m, err := tftp.Decode(bytes.NewBuffer(buffer[0:n]))
+        if err == nil && m.Opcode == 3 && m.Sz > e.blksize {
+            err = fmt.Errorf("malformed packet : DATA payload larger than the block size %d", e.blksize)
+        }
+        if err != nil {
+            e.log.warnf("%s, src=%s", err.Error(), src.String())
+            record_offense(src.IP, "malformed")
+            continue
+        }
+        e.log.debugf("<message-in>:%s", m.String())
+
+        // only the real peer can answer on our TID, it is not spoofed
+        e.guard.verify()
+        e.last_heard = time.Now()
+        return m, nil
+    }
+}
+
+// Aborts the session from another goroutine : the peer is told and closing
+// the socket makes the pending read of the session fail
+func (e *Endpoint) cancel() {
+    er := tftp.NewError(tftp.NotDefined, "Session cancelled by the server")
+    packet := tftp.Encode(er).Bytes()
+    capture_packet(e.addr, e.peer, false, e.session.info.Key, packet)
+    e.conn.WriteTo(packet, e.peer)
+    e.conn.Close()
+}
+
+// Someone other than the peer wrote to our TID, tell it off ( RFC 1350 ) but
+// keep the session going
+func (e *Endpoint) reject_unknown_tid(src *net.UDPAddr) {
+    record_offense(src.IP, "unknown_tid")
+    if is_banned(src.IP) {
+        return
+    }
+    er := tftp.NewError(tftp.UnknownTID, "Unknown transfer ID")
+    packet := tftp.Encode(er).Bytes()
+    if charge_unverified(src.IP.String(), len(packet)) == false {
+        return
+    }
+    capture_packet(e.addr, src, false, e.session.info.Key, packet)
+    n, err := e.conn.WriteTo(packet, src)
+    if err != nil {
+        e.log.warnf("<send> : failed to send %s : %s", er.String(), err.Error())
+        return
+    }
+    e.log.debugf("<send> : message-out=%s, bytes=%d, src=%s, dst=%s", er.String(), n, e.addr.String(), src.String())
+}
+
+// Waits for a message from the peer that accept returns true for, any other
+// message is ignored. The last packet sent is retransmitted on every
+// retransmission timeout, up to -retries times, ignored messages do not put
+// it off. An ERROR from the peer aborts
+func (e *Endpoint) receive(accept func(m *tftp.Message) bool) (m *tftp.Message, err error) {
+    timeouts := 0
+    deadline := time.Now().Add(e.rexmt)
+    for {
+        m, err := e.read(deadline)
+        if err != nil {
+            if ne, ok := err.(net.Error); ok == false || ne.Timeout() == false {
+                return nil, err
+            }
+            timeouts++
+            if timeouts > *maxRetries || time.Since(e.last_heard) > *sessionTimeout {
+                // a peer which answered and then went away abandoned the
+                // transfer, one which never did may be a spoofed source
+                if e.guard.verified == false {
+                    count("amp_suspected_spoof")
+                } else {
+                    record_offense(e.peer.IP, "failed_session")
+                }
+                return nil, fmt.Errorf("timed out waiting for %s", e.peer.String())
+            }
+            e.session.retransmitted()
+            metric_retransmissions.inc(e.session.info.Type)
+            count("retransmits")
+            e.log.infof("Timeout, retransmitting %s ( %d / %d )", e.last_msg, timeouts, *maxRetries)
+            if err := e.resend(); err != nil {
+                return nil, err
+            }
+            deadline = time.Now().Add(e.rexmt)
+            continue
+        }
+
+        if m.Opcode == 5 {
+            metric_errors.inc(strconv.Itoa(int(m.ErrCode)), "received")
+            return nil, &PeerError{ code : m.ErrCode, msg : m.ErrMsg }
+        }
+        if accept(m) {
+            return m, nil
+        }
+        e.log.debugf("Ignoring unexpected %s", m.String())
+    }
+}
+
+// The final ACK of a transfer may get lost, in which case the peer sends its
+// last DATA again. Hang around for a retransmission timeout to ACK it again,
+// ours at most : the peer may have negotiated one of minutes, for which the
+// session would hold its slot and socket
+func (e *Endpoint) dally(block uint16) {
+    deadline := time.Now().Add(min(e.rexmt, *rexmtTimeout))
+    for {
+        m, err := e.read(deadline)
+        if err != nil {
+            return
+        }
+        if m.Opcode == 3 && m.Block == block {
+            e.log.infof("Final ACK was lost, acknowledging again")
+            e.resend()
+        }
+    }
+}
+
+// Negotiates the options of a request ( RFC 2347 ) and returns the OACK to
+// answer with, nil when there is nothing to acknowledge. Unknown options and
+// options with bad values are left out, as the RFC mandates
+// - blksize ( RFC 2348 ) : bytes per DATA block, lowered to -max-blksize
+// - timeout ( RFC 2349 ) : the peer's retransmission timeout in seconds
+// - tsize ( RFC 2349 ) : the transfer size, tsize < 0 echoes the peer's value
+// - windowsize ( RFC 7440 ) : blocks per ACK, lowered to -max-windowsize
+// - offset ( non-standard, RRQ ) : the byte of file to start at, for clients
+//   resuming a download. Block 1 carries the bytes from there on
+// - sha256 ( non-standard, RRQ ) : answered with the SHA-256 of file whatever
+//   the value, for clients to check what they put together
+// - token, offset ( non-standard, WRQ ) : resumable uploads, answered by
+//   wrq_session
+// file is the file to be read, nil for writes in which case tsize echoes the
+// peer's value
+func negotiate_options(m *tftp.Message, e *Endpoint, file *File) (oack *tftp.Message) {
+    accepted := make(map[string]string)
+    for name, value := range m.Options {
+        if name == "timeout" {
+            secs, err := strconv.Atoi(value)
+            if err != nil || secs < 1 || secs > 255 {
+                continue
+            }
+            e.rexmt = time.Duration(secs) * time.Second
+            accepted[name] = value
+        } else if name == "blksize" {
+            sz, err := strconv.Atoi(value)
+            if err != nil || sz < 8 || sz > tftp.MaxBlksize {
+                continue
+            }
+            if sz > *maxBlksize {
+                sz = *maxBlksize
+            }
+            e.blksize = sz
+            accepted[name] = strconv.Itoa(sz)
+        } else if name == "windowsize" {
+            n, err := strconv.Atoi(value)
+            if err != nil || n < 1 || n > 65535 {
+                continue
+            }
+            if n > *maxWindowsize {
+                n = *maxWindowsize
+            }
+            e.windowsize = n
+            accepted[name] = strconv.Itoa(n)
+        } else if name == "tsize" {
+            if file == nil {
+                if _, err := strconv.Atoi(value); err != nil {
+                    continue
+                }
+                accepted[name] = value
+            } else {
+                accepted[name] = strconv.Itoa(file.sz)
+            }
+        } else if name == "offset" && file != nil {
+            off, err := strconv.Atoi(value)
+            if err != nil || off < 0 || off > file.sz {
+                continue
+            }
+            e.offset = off
+            accepted[name] = strconv.Itoa(off)
+        } else if name == "sha256" && file != nil {
+            accepted[name] = hex.EncodeToString(file.hash[:])
+        }
+    }
+    if len(accepted) == 0 {
+        return nil
+    }
+    tftp.SizeReadBuffer(e.conn, e.blksize, e.windowsize)
+
+    oack = new(tftp.Message)
+    oack.Opcode = 6
+    oack.Options = accepted
+    return oack
+}
@@ -0,0 +1,37 @@
+package main
+
+import(
+    "strings"
+    "testing"
+)
+
+func TestNormalizeFilename(t *testing.T) {
+    tests := []struct {
+        name string
+        want string
+        err bool
+    }{
+        { "file", "file", false },
+        { "/file", "file", false },
+        { "a//b/./c", "a/b/c", false },
+        { "a/b/../c", "a/c", false },
+        { "../etc/passwd", "", true },
+        { "a/../..", "", true },
+        { "", "", true },
+        { "/", "", true },
+        { "bad\nname", "", true },
+        { "del\x7f", "", true },
+        { strings.Repeat("x", 256), "", true },
+        { strings.Repeat("x", 255), strings.Repeat("x", 255), false },
+    }
+    for _, tt := range tests {
+        got, err := normalize_filename(tt.name)
+        if (err != nil) != tt.err {
+            t.Errorf("normalize_filename(%q) : error %v, want error %v", tt.name, err, tt.err)
+            continue
+        }
+        if got != tt.want {
+            t.Errorf("normalize_filename(%q) = %q, want %q", tt.name, got, tt.want)
+        }
+    }
+}
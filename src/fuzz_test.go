@@ -0,0 +1,288 @@
+package main
+
+import(
+    "bytes"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "net"
+    "strconv"
+    "sync/atomic"
+    "testing"
+    "time"
+    "ttftp/tftp"
+)
+
+// ---------------------------------
+// Session Fuzzing
+// ---------------------------------
+// A peer of the in-process server sends a request with fuzzed options, then
+// a fuzzed sequence of packets to the session and an ERROR to end it. The
+// session must be gone shortly after, whatever it was sent, and what it
+// answered and stored must agree with a model of the protocol
+//
+// go test -fuzz FuzzWRQSession ./src, and so on for each target. Without
+// -fuzz the seeds run as ordinary tests
+
+var fuzz_keys int64
+
+// Fast retransmissions and no amplification limits, so sessions end quickly
+// and answer whatever the fuzzer sends
+func fuzz_sessions(f *testing.F) {
+    rexmt, retries, budget := *rexmtTimeout, *maxRetries, *responseBudget
+    change_flags(f, func() {
+        *rexmtTimeout, *maxRetries, *responseBudget = 10 * time.Millisecond, 100, 0
+    })
+    f.Cleanup(func() {
+        change_flags(f, func() {
+            *rexmtTimeout, *maxRetries, *responseBudget = rexmt, retries, budget
+        })
+    })
+}
+
+// Turns fuzz input into packets, 4 bytes per packet : a kind, a block
+// number or error code and a payload length, followed by the payload. Kinds
+// are DATA, ACK, raw bytes and ERROR
+func fuzz_packets(ops []byte) (packets [][]byte) {
+    for len(ops) >= 4 && len(packets) < 64 {
+        kind := ops[0] % 4
+        block := binary.BigEndian.Uint16(ops[1:3])
+        payload := ops[4:min(4 + int(ops[3]), len(ops))]
+        ops = ops[4 + len(payload):]
+        switch kind {
+        case 0:
+            packets = append(packets, tftp.Encode(&tftp.Message{ Opcode : 3, Block : block, Payload : payload, Sz : len(payload) }).Bytes())
+        case 1:
+            packets = append(packets, tftp.Encode(tftp.NewAck(block)).Bytes())
+        case 2:
+            packets = append(packets, payload)
+        case 3:
+            packets = append(packets, tftp.Encode(tftp.NewError(block % 9, string(payload))).Bytes())
+        }
+    }
+    return packets
+}
+
+// Options of the request, without timeout which would keep a dallying
+// session around for up to 255 seconds
+func fuzz_options(data []byte) (map[string]string) {
+    // decoded as the options of a request
+    m, err := tftp.Decode(bytes.NewBuffer(append([]byte("\x00\x01f\x00octet\x00"), data...)))
+    if err != nil {
+        return nil
+    }
+    delete(m.Options, "timeout")
+    return m.Options
+}
+
+// Runs one session : sends req, the packets and an ERROR, waits for the
+// session to end and returns the OACK and everything else the session sent
+func fuzz_exchange(t *testing.T, req *tftp.Message, packets [][]byte) (oack *tftp.Message, received []*tftp.Message) {
+    request := tftp.Encode(req).Bytes()
+    if len(request) > tftp.BlockSize {
+        t.Skip("request larger than a packet")
+    }
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{ IP : net.IPv4(127, 0, 0, 1) })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetReadBuffer(4 * 1024 * 1024)
+    if _, err := conn.WriteTo(request, test_server.addr); err != nil {
+        t.Fatal(err)
+    }
+
+    // the first answer comes from the session TID
+    buffer := make([]byte, tftp.DataHeaderBytes + tftp.MaxBlksize + 1)
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    n, tid, err := conn.ReadFromUDP(buffer)
+    if err != nil {
+        t.Fatalf("no answer to %s : %s", req.String(), err.Error())
+    }
+    first, err := tftp.Decode(bytes.NewBuffer(buffer[0:n]))
+    if err != nil {
+        t.Fatalf("server answered %s with a malformed packet : %s", req.String(), err.Error())
+    }
+    if first.Opcode == 5 {
+        t.Fatalf("%s refused : %s", req.String(), first.String())
+    }
+    if first.Opcode == 6 {
+        oack = first
+    } else {
+        received = append(received, first)
+    }
+
+    for _, packet := range packets {
+        conn.WriteTo(packet, tid)
+    }
+    conn.WriteTo(tftp.Encode(tftp.NewError(tftp.NotDefined, "fuzzing done")).Bytes(), tid)
+
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        active := false
+        for _, info := range list_sessions() {
+            active = active || info.Key == req.Key
+        }
+        if active == false {
+            break
+        }
+        if time.Now().After(deadline) == true {
+            t.Fatalf("session of %s still active 5s after its ERROR", req.String())
+        }
+        time.Sleep(time.Millisecond)
+    }
+
+    for {
+        conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+        n, src, err := conn.ReadFromUDP(buffer)
+        if err != nil {
+            return oack, received
+        }
+        if src.String() != tid.String() {
+            t.Fatalf("packet from %s, the session is %s", src.String(), tid.String())
+        }
+        m, err := tftp.Decode(bytes.NewBuffer(buffer[0:n]))
+        if err != nil {
+            t.Fatalf("session sent a malformed packet : %s", err.Error())
+        }
+        received = append(received, m)
+    }
+}
+
+// Checks the OACK against the options requested, returns the block size
+func check_oack(t *testing.T, options map[string]string, oack *tftp.Message) (blksize int) {
+    blksize = tftp.BlockSize
+    if oack == nil {
+        return blksize
+    }
+    for name, value := range oack.Options {
+        if _, ok := options[name]; ok == false {
+            t.Fatalf("OACK option %s=%s not requested", name, value)
+        }
+    }
+    if value, ok := oack.Options["blksize"]; ok == true {
+        blksize, _ = strconv.Atoi(value)
+        requested, _ := strconv.Atoi(options["blksize"])
+        if blksize < 8 || blksize > requested || blksize > *maxBlksize {
+            t.Fatalf("OACK blksize %s for %s", value, options["blksize"])
+        }
+    }
+    if value, ok := oack.Options["windowsize"]; ok == true {
+        n, _ := strconv.Atoi(value)
+        requested, _ := strconv.Atoi(options["windowsize"])
+        if n < 1 || n > requested || n > *maxWindowsize {
+            t.Fatalf("OACK windowsize %s for %s", value, options["windowsize"])
+        }
+    }
+    return blksize
+}
+
+func FuzzWRQSession(f *testing.F) {
+    fuzz_sessions(f)
+    f.Add([]byte(""), []byte("\x00\x00\x01\x03abc"))
+    f.Add([]byte("blksize\x008\x00"), []byte("\x00\x00\x01\x08abcdefgh\x00\x00\x02\x08ijklmnop\x00\x00\x02\x08ijklmnop\x00\x00\x03\x02qr"))
+    f.Add([]byte("blksize\x008\x00windowsize\x002\x00tsize\x0010\x00"), []byte("\x00\x00\x02\x08abcdefgh\x00\x00\x01\x08abcdefgh\x00\x00\x02\x02ij"))
+    f.Add([]byte("blksize\x008\x00"), []byte("\x00\x00\x01\x09too long!\x02\x00\x00\x05\x00\x04\x00\x01x\x03\x00\x00\x00"))
+    f.Add([]byte("token\x00t\x00offset\x000\x00"), []byte("\x00\x00\x01\x00"))
+
+    f.Fuzz(func(t *testing.T, options []byte, ops []byte) {
+        key := fmt.Sprintf("fuzz/wrq/%d", atomic.AddInt64(&fuzz_keys, 1))
+        req := &tftp.Message{ Opcode : 1, Key : key, Mode : "octet", Options : fuzz_options(options) }
+        oack, received := fuzz_exchange(t, req, fuzz_packets(ops))
+        defer del(key)
+        blksize := check_oack(t, req.Options, oack)
+
+        // the server takes the DATA blocks in sequence up to the first short
+        // one, larger blocks are malformed, an ERROR ends the session
+        var content []byte
+        expected := 1
+        complete := false
+        for _, packet := range fuzz_packets(ops) {
+            if len(packet) > tftp.DataHeaderBytes + blksize + 1 {
+                packet = packet[0:tftp.DataHeaderBytes + blksize + 1]
+            }
+            m, err := tftp.Decode(bytes.NewBuffer(packet))
+            if err != nil || m.Opcode == 3 && m.Sz > blksize {
+                continue
+            }
+            if m.Opcode == 5 {
+                break
+            }
+            if m.Opcode != 3 || int(m.Block) != expected {
+                continue
+            }
+            content = append(content, m.Payload...)
+            expected++
+            if m.Sz < blksize {
+                complete = true
+                break
+            }
+        }
+
+        for _, m := range received {
+            if m.Opcode != 4 || int(m.Block) >= expected {
+                t.Fatalf("session sent %s, %d blocks received in sequence", m.String(), expected - 1)
+            }
+        }
+        file, ok := get(key)
+        if ok != complete {
+            t.Fatalf("file stored %v, upload complete %v", ok, complete)
+        }
+        if ok == true && file.hash != sha256.Sum256(content) {
+            t.Fatalf("stored %d bytes, want %d", file.sz, len(content))
+        }
+    })
+}
+
+func FuzzRRQSession(f *testing.F) {
+    fuzz_sessions(f)
+    f.Add(uint16(1000), []byte(""), []byte("\x01\x00\x01\x00\x01\x00\x02\x00"))
+    f.Add(uint16(20), []byte("blksize\x008\x00"), []byte("\x01\x00\x00\x00\x01\x00\x01\x00\x01\x00\x02\x00\x01\x00\x03\x00"))
+    f.Add(uint16(64), []byte("blksize\x008\x00windowsize\x004\x00"), []byte("\x01\x00\x00\x00\x01\x00\x02\x00\x01\x00\x08\x00\x01\x00\x06\x00"))
+    f.Add(uint16(50), []byte("blksize\x008\x00offset\x0020\x00sha256\x000\x00tsize\x000\x00"), []byte("\x01\x00\x00\x00\x01\x00\x01\x00\x01\x00\x09\x00"))
+    f.Add(uint16(0), []byte("tsize\x000\x00"), []byte("\x01\x00\x00\x00\x01\x00\x01\x00"))
+
+    f.Fuzz(func(t *testing.T, size uint16, options []byte, ops []byte) {
+        key := fmt.Sprintf("fuzz/rrq/%d", atomic.AddInt64(&fuzz_keys, 1))
+        content := random_content(int64(size), int(size) % 5000)
+        put(key, create_file(content))
+        defer del(key)
+        req := &tftp.Message{ Opcode : 2, Key : key, Mode : "octet", Options : fuzz_options(options) }
+        oack, received := fuzz_exchange(t, req, fuzz_packets(ops))
+        blksize := check_oack(t, req.Options, oack)
+
+        offset := 0
+        if oack != nil {
+            if value, ok := oack.Options["tsize"]; ok == true && value != strconv.Itoa(len(content)) {
+                t.Fatalf("OACK tsize %s for %d bytes", value, len(content))
+            }
+            hash := sha256.Sum256(content)
+            if value, ok := oack.Options["sha256"]; ok == true && value != hex.EncodeToString(hash[:]) {
+                t.Fatalf("OACK sha256 %s", value)
+            }
+            if value, ok := oack.Options["offset"]; ok == true {
+                offset, _ = strconv.Atoi(value)
+                if offset < 0 || offset > len(content) {
+                    t.Fatalf("OACK offset %s for %d bytes", value, len(content))
+                }
+            }
+        }
+
+        // block n holds the bytes from offset + ( n - 1 ) * blksize, none
+        // past the end of the file
+        for _, m := range received {
+            if m.Opcode != 3 || m.Block == 0 {
+                t.Fatalf("session sent %s", m.String())
+            }
+            start := offset + (int(m.Block) - 1) * blksize
+            if start > len(content) {
+                t.Fatalf("DATA Block=%d past the end of %d bytes", m.Block, len(content))
+            }
+            want := content[start:min(start + blksize, len(content))]
+            if bytes.Equal(m.Payload[0:m.Sz], want) == false {
+                t.Fatalf("DATA Block=%d of %d bytes, want %d bytes from %d", m.Block, m.Sz, len(want), start)
+            }
+        }
+    })
+}
@@ -0,0 +1,343 @@
+package main
+
+import(
+    "crypto/subtle"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "ttftp/tftp"
+)
+
+// ---------------------------------
+// HTTP Admin API
+// ---------------------------------
+// Optional HTTP listener over the same file store and server state, all
+// responses but file contents are JSON :
+//
+//   GET    /files?prefix=p   list keys ( with size, mtime and sha256 )
+//   GET    /files/<key>      file contents
+//   PUT    /files/<key>      upload, visible only once fully received
+//   DELETE /files/<key>      remove a key
+//   GET    /meta/<key>       file metadata
+//   GET    /sessions         active sessions
+//   DELETE /sessions/<id>    cancel a session
+//   GET    /config           server configuration
+//   GET    /counters         counters and store statistics
+//   GET    /metrics          Prometheus metrics ( text format )
+//
+// Keys go through the same filename policy as TFTP requests. Downloads and
+// listings are refused like an RRQ would be, uploads and deletes like a WRQ :
+// by the server mode and by the rules of the access list for the address of
+// the HTTP peer, listings only show the keys it may read. /config redacts
+// secrets such as -http-token. Uploads are capped at -http-max-upload bytes
+// and slow clients are cut off after -http-timeout.
+//
+// An address without a host listens on localhost. Any other than a loopback
+// address requires -http-token, which clients then send on every request as
+// "Authorization: Bearer <token>"
+var httpAddr = flag.String("http-addr", "", "address of the HTTP admin API, localhost when no host is given, empty disables")
+var httpToken = flag.String("http-token", "", "bearer token required by the HTTP admin API, mandatory unless it listens on a loopback address")
+var httpMaxUpload = flag.Int64("http-max-upload", 1 << 30, "largest upload the HTTP admin API takes, in bytes")
+var httpTimeout = flag.Duration("http-timeout", 5 * time.Minute, "time an HTTP admin API request may take to be read, its headers get 10 seconds")
+
+// Flags whose values /config does not show
+var secret_flags = map[string]bool{ "http-token" : true }
+
+var http_log = new_logger("HTTP")
+
+func start_http(addr string) (error) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/files", http_files)
+    mux.HandleFunc("/files/", http_file)
+    mux.HandleFunc("/meta/", http_meta)
+    mux.HandleFunc("/sessions", http_sessions)
+    mux.HandleFunc("/sessions/", http_session)
+    mux.HandleFunc("/config", http_config)
+    mux.HandleFunc("/counters", http_counters)
+    mux.HandleFunc("/metrics", http_metrics)
+
+    host, port, err := net.SplitHostPort(addr)
+    if err != nil {
+        return err
+    }
+    if host == "" {
+        host = "localhost"
+    }
+    if *httpToken == "" && is_loopback(host) == false {
+        return fmt.Errorf("http-addr %s is not a loopback address, set -http-token", addr)
+    }
+    addr = net.JoinHostPort(host, port)
+
+    ln, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    http_log.infof("Listening on %s", addr)
+    srv := &http.Server{
+        Handler : http_auth(mux),
+        ReadHeaderTimeout : 10 * time.Second,
+        ReadTimeout : *httpTimeout,
+    }
+    go srv.Serve(ln)
+    return nil
+}
+
+func is_loopback(host string) (bool) {
+    if host == "localhost" {
+        return true
+    }
+    ip := net.ParseIP(host)
+    return ip != nil && ip.IsLoopback()
+}
+
+// Refuses requests without the bearer token, when there is one
+func http_auth(next http.Handler) (http.Handler) {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if *httpToken != "" {
+            want := "Bearer " + *httpToken
+            if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+                http_log.warnf("Unauthorized %s %s, src=%s", r.Method, r.URL.Path, r.RemoteAddr)
+                w.Header().Set("WWW-Authenticate", "Bearer")
+                write_json_error(w, http.StatusUnauthorized, "unauthorized")
+                return
+            }
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+func write_json(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+func write_json_error(w http.ResponseWriter, status int, msg string) {
+    write_json(w, status, map[string]string{ "error" : msg })
+}
+
+// Extracts and normalizes the key of /files/<key> and /meta/<key>
+func http_key(w http.ResponseWriter, r *http.Request, prefix string) (key string, ok bool) {
+    key, err := normalize_filename(strings.TrimPrefix(r.URL.Path, prefix))
+    if err != nil {
+        write_json_error(w, http.StatusBadRequest, err.Error())
+        return "", false
+    }
+    return key, true
+}
+
+func http_files(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        write_json_error(w, http.StatusMethodNotAllowed, "method not allowed")
+        return
+    }
+    if http_may(w, r, 2, "list", "", "") == false {
+        return
+    }
+    ip := http_peer_ip(r)
+    infos := []FileInfo{}
+    for _, fi := range list(r.URL.Query().Get("prefix")) {
+        if acl_allows(ip, "read", fi.Key) {
+            infos = append(infos, fi)
+        }
+    }
+    write_json(w, http.StatusOK, infos)
+}
+
+func http_file(w http.ResponseWriter, r *http.Request) {
+    key, ok := http_key(w, r, "/files/")
+    if ok == false {
+        return
+    }
+    http_log.infof("%s %s, src=%s", r.Method, key, r.RemoteAddr)
+
+    if r.Method == "GET" || r.Method == "HEAD" {
+        if http_may_read(w, r, key) == false {
+            return
+        }
+        file, ok := get(key)
+        if ok == false {
+            write_json_error(w, http.StatusNotFound, "file not found")
+            return
+        }
+        w.Header().Set("Content-Type", "application/octet-stream")
+        w.Header().Set("Content-Length", strconv.Itoa(file.sz))
+        w.Header().Set("ETag", fmt.Sprintf("\"%x\"", file.hash))
+        w.Header().Set("Last-Modified", file.mtime.UTC().Format(http.TimeFormat))
+        if r.Method == "HEAD" {
+            return
+        }
+        for _, seg := range file.segs {
+            if _, err := w.Write(seg); err != nil {
+                return
+            }
+        }
+    } else if r.Method == "PUT" {
+        if http_may_write(w, r, "write", key) == false {
+            return
+        }
+        if _, is_index := index_prefix(key); is_index == true {
+            write_json_error(w, http.StatusForbidden, "reserved filename")
+            return
+        }
+        // fill a private file first, the key only flips once it is complete
+        fw := new_file_writer()
+        body := http.MaxBytesReader(w, r.Body, *httpMaxUpload)
+        var buf [64 * 1024]byte
+        for {
+            n, err := body.Read(buf[0:])
+            fw.write(buf[0:n])
+            if err == io.EOF {
+                break
+            }
+            if err != nil {
+                audit_http(r, "write", key, nil, err)
+                status := http.StatusBadRequest
+                var too_large *http.MaxBytesError
+                if errors.As(err, &too_large) == true {
+                    status = http.StatusRequestEntityTooLarge
+                }
+                write_json_error(w, status, err.Error())
+                return
+            }
+        }
+        file := fw.close()
+        put(key, file)
+        audit_http(r, "write", key, file, nil)
+        info, _ := stat(key)
+        write_json(w, http.StatusCreated, info)
+    } else if r.Method == "DELETE" {
+        if http_may_write(w, r, "delete", key) == false {
+            return
+        }
+        file, _ := get(key)
+        if del(key) == false {
+            write_json_error(w, http.StatusNotFound, "file not found")
+            return
+        }
+        audit_http(r, "delete", key, file, nil)
+        w.WriteHeader(http.StatusNoContent)
+    } else {
+        write_json_error(w, http.StatusMethodNotAllowed, "method not allowed")
+    }
+}
+
+// Refuses a download of key as an RRQ of it would be
+func http_may_read(w http.ResponseWriter, r *http.Request, key string) (bool) {
+    return http_may(w, r, 2, "read", "read", key)
+}
+
+// Refuses an upload or delete ( op ) of key as a WRQ of it would be
+func http_may_write(w http.ResponseWriter, r *http.Request, op string, key string) (bool) {
+    return http_may(w, r, 1, op, "write", key)
+}
+
+// Refuses op of key as a TFTP request with opcode would be refused : by the
+// server mode, then by the acl_op rules of the access list unless acl_op is
+// empty. Refusals are answered and audited
+func http_may(w http.ResponseWriter, r *http.Request, opcode uint16, op string, acl_op string, key string) (bool) {
+    status, msg := 0, ""
+    if ok, code, mode_msg := check_server_mode(opcode); ok == false {
+        status, msg = http.StatusForbidden, mode_msg
+        if code == tftp.NotDefined {
+            status = http.StatusServiceUnavailable
+        }
+    } else if acl_op != "" && acl_allows(http_peer_ip(r), acl_op, key) == false {
+        status, msg = http.StatusForbidden, "Access violation"
+    }
+    if status == 0 {
+        return true
+    }
+    http_log.warnf("Refusing %s of %q to %s : %s", op, key, r.RemoteAddr, msg)
+    audit_http_refused(r, op, key, msg)
+    write_json_error(w, status, msg)
+    return false
+}
+
+// The address of the HTTP peer, nil when it has none which no rule matches
+func http_peer_ip(r *http.Request) (net.IP) {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return nil
+    }
+    return net.ParseIP(host)
+}
+
+func http_meta(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        write_json_error(w, http.StatusMethodNotAllowed, "method not allowed")
+        return
+    }
+    key, ok := http_key(w, r, "/meta/")
+    if ok == false {
+        return
+    }
+    if http_may_read(w, r, key) == false {
+        return
+    }
+    info, ok := stat(key)
+    if ok == false {
+        write_json_error(w, http.StatusNotFound, "file not found")
+        return
+    }
+    write_json(w, http.StatusOK, info)
+}
+
+func http_sessions(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        write_json_error(w, http.StatusMethodNotAllowed, "method not allowed")
+        return
+    }
+    write_json(w, http.StatusOK, list_sessions())
+}
+
+func http_session(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "DELETE" {
+        write_json_error(w, http.StatusMethodNotAllowed, "method not allowed")
+        return
+    }
+    id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/sessions/"), 10, 64)
+    if err != nil {
+        write_json_error(w, http.StatusBadRequest, "bad session id")
+        return
+    }
+    if err := cancel_session(id); err != nil {
+        write_json_error(w, http.StatusNotFound, err.Error())
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func http_config(w http.ResponseWriter, r *http.Request) {
+    config := make(map[string]string)
+    flag.VisitAll(func(f *flag.Flag) {
+        config[f.Name] = f.Value.String()
+        if secret_flags[f.Name] == true && config[f.Name] != "" {
+            config[f.Name] = "<redacted>"
+        }
+    })
+    // the mode may have been switched at runtime
+    config["server-mode"] = get_server_mode()
+    write_json(w, http.StatusOK, config)
+}
+
+func http_counters(w http.ResponseWriter, r *http.Request) {
+    keys, logical_bytes, physical_bytes := store_stats()
+    write_json(w, http.StatusOK, map[string]interface{}{
+        "counters" : counter_snapshot(),
+        "store" : map[string]int{
+            "keys" : keys,
+            "logical_bytes" : logical_bytes,
+            "physical_bytes" : physical_bytes,
+        },
+        "sessions" : len(list_sessions()),
+        "time" : time.Now(),
+    })
+}
@@ -0,0 +1,236 @@
+package main
+
+import(
+    "flag"
+    "fmt"
+    "math/rand"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// ---------------------------------
+// Network Impairment
+// ---------------------------------
+// A net.PacketConn wrapper which simulates a bad network on the packets it
+// writes : dropped, duplicated, delayed, reordered or with a bit flipped,
+// each with its own probability. Every socket draws from a generator seeded
+// with the seed and the number of sockets impaired before it, so a run with
+// the same seed and the same sockets gets the same faults. Only writes are
+// impaired, impairing both ends covers both directions. For testing
+// retransmissions and duplicate handling, the server impairs its sockets with
+// -impair and the client commands with their own -impair flag
+var impairSpec = flag.String("impair", "", "impair the packets the server sends, e.g. drop=0.2,dup=0.05,reorder=0.1,corrupt=0.01,delay=10ms,jitter=5ms,seed=1 ( testing only )")
+
+// How long a reordered packet waits for a later one to overtake it
+const reorder_hold time.Duration = 20 * time.Millisecond
+
+type Impairment struct {
+    Drop float64
+    Dup float64
+    Reorder float64
+    Corrupt float64
+    Delay time.Duration
+    Jitter time.Duration
+    Seed int64
+    conns int64
+}
+
+// Parses a comma separated list of name=value, names : drop, dup, reorder,
+// corrupt ( probabilities ), delay, jitter ( durations ) and seed. An empty
+// spec is no impairment
+func parse_impairment(spec string) (imp *Impairment, err error) {
+    if spec == "" {
+        return nil, nil
+    }
+    imp = new(Impairment)
+    imp.Seed = 1
+    for _, field := range strings.Split(spec, ",") {
+        name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+        if ok == false {
+            return nil, fmt.Errorf("impairment %q is not name=value", field)
+        }
+        switch name {
+        case "drop", "dup", "reorder", "corrupt":
+            p, err := strconv.ParseFloat(value, 64)
+            if err != nil || p < 0 || p > 1 {
+                return nil, fmt.Errorf("impairment %s must be a probability between 0 and 1", name)
+            }
+            switch name {
+            case "drop":
+                imp.Drop = p
+            case "dup":
+                imp.Dup = p
+            case "reorder":
+                imp.Reorder = p
+            case "corrupt":
+                imp.Corrupt = p
+            }
+        case "delay", "jitter":
+            d, err := time.ParseDuration(value)
+            if err != nil || d < 0 {
+                return nil, fmt.Errorf("impairment %s must be a positive duration", name)
+            }
+            if name == "delay" {
+                imp.Delay = d
+            } else {
+                imp.Jitter = d
+            }
+        case "seed":
+            imp.Seed, err = strconv.ParseInt(value, 10, 64)
+            if err != nil {
+                return nil, fmt.Errorf("impairment seed must be an integer")
+            }
+        default:
+            return nil, fmt.Errorf("unknown impairment %q", name)
+        }
+    }
+    return imp, nil
+}
+
+func (imp *Impairment) String() (string) {
+    return fmt.Sprintf("drop=%g,dup=%g,reorder=%g,corrupt=%g,delay=%s,jitter=%s,seed=%d",
+        imp.Drop, imp.Dup, imp.Reorder, imp.Corrupt, imp.Delay, imp.Jitter, imp.Seed)
+}
+
+type ImpairedConn struct {
+    net.PacketConn
+    sync.Mutex
+    imp *Impairment
+    rng *rand.Rand
+    held *impaired_packet
+}
+
+type impaired_packet struct {
+    packet []byte
+    addr net.Addr
+    copies int
+}
+
+// Wraps conn, a nil imp leaves it alone
+func impair_conn(conn net.PacketConn, imp *Impairment) (net.PacketConn) {
+    if imp == nil {
+        return conn
+    }
+    c := new(ImpairedConn)
+    c.PacketConn = conn
+    c.imp = imp
+    c.rng = rand.New(rand.NewSource(imp.Seed + atomic.AddInt64(&imp.conns, 1) - 1))
+    return c
+}
+
+// Wraps the sockets of a client, a nil imp leaves them alone
+func impair_client(imp *Impairment) (func(net.PacketConn) net.PacketConn) {
+    if imp == nil {
+        return nil
+    }
+    return func(conn net.PacketConn) net.PacketConn {
+        return impair_conn(conn, imp)
+    }
+}
+
+// Always reports the whole packet written, a lost packet is not an error
+func (c *ImpairedConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+    c.Lock()
+    defer c.Unlock()
+    if c.rng.Float64() < c.imp.Drop {
+        count("impair_dropped")
+        return len(p), nil
+    }
+    // the caller may reuse p before a delayed copy goes out
+    packet := append([]byte{}, p...)
+    if len(packet) > 0 && c.rng.Float64() < c.imp.Corrupt {
+        packet[c.rng.Intn(len(packet))] ^= 1 << uint(c.rng.Intn(8))
+        count("impair_corrupted")
+    }
+    copies := 1
+    if c.rng.Float64() < c.imp.Dup {
+        copies = 2
+        count("impair_duplicated")
+    }
+    if c.held == nil && c.rng.Float64() < c.imp.Reorder {
+        // goes out after the next packet, or on its own if none follows
+        held := &impaired_packet{ packet : packet, addr : addr, copies : copies }
+        c.held = held
+        count("impair_reordered")
+        time.AfterFunc(reorder_hold, func() {
+            c.Lock()
+            defer c.Unlock()
+            if c.held == held {
+                c.held = nil
+                c.deliver(held)
+            }
+        })
+        return len(p), nil
+    }
+
+    err = c.deliver(&impaired_packet{ packet : packet, addr : addr, copies : copies })
+    if c.held != nil {
+        held := c.held
+        c.held = nil
+        c.deliver(held)
+    }
+    if err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
+
+// Caller holds the lock. Delayed copies are written from timers, when the
+// socket is closed by then they are lost
+func (c *ImpairedConn) deliver(p *impaired_packet) (error) {
+    for i := 0; i < p.copies; i++ {
+        delay := c.imp.Delay
+        if c.imp.Jitter > 0 {
+            delay += time.Duration(c.rng.Int63n(int64(c.imp.Jitter)))
+        }
+        if delay == 0 {
+            if _, err := c.PacketConn.WriteTo(p.packet, p.addr); err != nil {
+                return err
+            }
+            continue
+        }
+        time.AfterFunc(delay, func() {
+            c.PacketConn.WriteTo(p.packet, p.addr)
+        })
+    }
+    return nil
+}
+
+// Sized like the socket it wraps, see tftp.SizeReadBuffer
+func (c *ImpairedConn) SetReadBuffer(bytes int) (error) {
+    if rb, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok == true {
+        return rb.SetReadBuffer(bytes)
+    }
+    return nil
+}
+
+// The impairment of the sockets the server opens from now on, nil for none
+var server_impairment = struct {
+    sync.Mutex
+    imp *Impairment
+} {}
+
+func set_server_impairment(imp *Impairment) {
+    server_impairment.Lock()
+    defer server_impairment.Unlock()
+    server_impairment.imp = imp
+}
+
+func get_server_impairment() (*Impairment) {
+    server_impairment.Lock()
+    defer server_impairment.Unlock()
+    return server_impairment.imp
+}
+
+// Reads a packet from conn, whose peers are all UDP addresses
+func read_udp(conn net.PacketConn, buffer []byte) (n int, src *net.UDPAddr, err error) {
+    n, addr, err := conn.ReadFrom(buffer)
+    if err != nil {
+        return n, nil, err
+    }
+    return n, addr.(*net.UDPAddr), nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import(
+    "encoding/binary"
+    "fmt"
+    "net"
+    "testing"
+    "time"
+    "ttftp/tftp"
+)
+
+func TestParseImpairment(t *testing.T) {
+    tests := []struct {
+        spec string
+        want *Impairment
+        err bool
+    }{
+        { "", nil, false },
+        { "drop=0.2", &Impairment{ Drop : 0.2, Seed : 1 }, false },
+        { "drop=0.1, dup=0.05,reorder=1,corrupt=0,delay=10ms,jitter=1s,seed=-7",
+            &Impairment{ Drop : 0.1, Dup : 0.05, Reorder : 1, Delay : 10 * time.Millisecond, Jitter : time.Second, Seed : -7 }, false },
+        { "drop=1.5", nil, true },
+        { "dup=-0.1", nil, true },
+        { "delay=fast", nil, true },
+        { "seed=x", nil, true },
+        { "loss=0.2", nil, true },
+        { "drop", nil, true },
+    }
+    for _, tt := range tests {
+        got, err := parse_impairment(tt.spec)
+        if (err != nil) != tt.err {
+            t.Errorf("parse_impairment(%q) : error %v, want error %v", tt.spec, err, tt.err)
+            continue
+        }
+        if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+            t.Errorf("parse_impairment(%q) = %+v, want %+v", tt.spec, got, tt.want)
+        }
+    }
+}
+
+// Sends n numbered packets through an impaired socket and returns what
+// arrived, in order
+func impaired_packets(t *testing.T, imp *Impairment, n int) ([][]byte) {
+    src, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer src.Close()
+    dst, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer dst.Close()
+
+    conn := impair_conn(src, imp)
+    for i := 0; i < n; i++ {
+        packet := make([]byte, 8)
+        binary.BigEndian.PutUint64(packet, uint64(i))
+        if _, err := conn.WriteTo(packet, dst.LocalAddr()); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    var got [][]byte
+    buffer := make([]byte, 64)
+    for {
+        dst.SetReadDeadline(time.Now().Add(imp.Delay + imp.Jitter + 2 * reorder_hold))
+        n, _, err := dst.ReadFrom(buffer)
+        if err != nil {
+            return got
+        }
+        got = append(got, append([]byte{}, buffer[0:n]...))
+    }
+}
+
+func packet_numbers(packets [][]byte) ([]uint64) {
+    numbers := make([]uint64, len(packets))
+    for i, packet := range packets {
+        numbers[i] = binary.BigEndian.Uint64(packet)
+    }
+    return numbers
+}
+
+func TestImpairedConn(t *testing.T) {
+    // all of them queue up in the socket buffer before they are read
+    const n = 100
+    t.Run("drop", func(t *testing.T) {
+        got := impaired_packets(t, &Impairment{ Drop : 0.2, Seed : 9 }, n)
+        if len(got) < n * 6 / 10 || len(got) > n * 95 / 100 {
+            t.Errorf("%d of %d packets arrived with 20%% loss", len(got), n)
+        }
+        // the same seed loses the same packets
+        again := impaired_packets(t, &Impairment{ Drop : 0.2, Seed : 9 }, n)
+        if fmt.Sprint(packet_numbers(got)) != fmt.Sprint(packet_numbers(again)) {
+            t.Errorf("two runs with the same seed lost different packets")
+        }
+        other := impaired_packets(t, &Impairment{ Drop : 0.2, Seed : 10 }, n)
+        if fmt.Sprint(packet_numbers(got)) == fmt.Sprint(packet_numbers(other)) {
+            t.Errorf("two runs with different seeds lost the same packets")
+        }
+    })
+    t.Run("dup", func(t *testing.T) {
+        got := packet_numbers(impaired_packets(t, &Impairment{ Dup : 1 }, n))
+        if len(got) != 2 * n {
+            t.Fatalf("%d packets arrived, want %d", len(got), 2 * n)
+        }
+        for i, number := range got {
+            if number != uint64(i / 2) {
+                t.Fatalf("packet %d is number %d, want %d", i, number, i / 2)
+            }
+        }
+    })
+    t.Run("reorder", func(t *testing.T) {
+        // every other packet is held until the next one went out
+        got := packet_numbers(impaired_packets(t, &Impairment{ Reorder : 1 }, n))
+        if len(got) != n {
+            t.Fatalf("%d packets arrived, want %d", len(got), n)
+        }
+        for i, number := range got {
+            if number != uint64(i ^ 1) {
+                t.Fatalf("packet %d is number %d, want %d", i, number, i ^ 1)
+            }
+        }
+    })
+    t.Run("corrupt", func(t *testing.T) {
+        got := impaired_packets(t, &Impairment{ Corrupt : 1 }, n)
+        if len(got) != n {
+            t.Fatalf("%d packets arrived, want %d", len(got), n)
+        }
+        for i, packet := range got {
+            want := make([]byte, 8)
+            binary.BigEndian.PutUint64(want, uint64(i))
+            flipped := 0
+            for j := range packet {
+                for d := packet[j] ^ want[j]; d != 0; d &= d - 1 {
+                    flipped++
+                }
+            }
+            if flipped != 1 {
+                t.Fatalf("packet %d has %d bits flipped, want 1", i, flipped)
+            }
+        }
+    })
+    t.Run("delay", func(t *testing.T) {
+        start := time.Now()
+        got := impaired_packets(t, &Impairment{ Delay : 30 * time.Millisecond }, 10)
+        if len(got) != 10 {
+            t.Fatalf("%d packets arrived, want 10", len(got))
+        }
+        if elapsed := time.Since(start); elapsed < 30 * time.Millisecond {
+            t.Errorf("packets arrived after %s, want at least 30ms", elapsed)
+        }
+    })
+}
+
+// Transfers through a lossy network both ways : they complete, the content
+// is intact and the packets lost were retransmitted
+func TestImpairedTransfers(t *testing.T) {
+    rexmt, retries := *rexmtTimeout, *maxRetries
+    change_flags(t, func() {
+        *rexmtTimeout, *maxRetries = 50 * time.Millisecond, 20
+    })
+    defer change_flags(t, func() {
+        *rexmtTimeout, *maxRetries = rexmt, retries
+        set_server_impairment(nil)
+    })
+
+    tests := []struct {
+        name string
+        server Impairment
+        client Impairment
+        blksize int
+        windowsize int
+    }{
+        { "loss", Impairment{ Drop : 0.2, Seed : 1 }, Impairment{ Drop : 0.2, Seed : 2 }, tftp.BlockSize, 1 },
+        { "loss windowed", Impairment{ Drop : 0.2, Seed : 3 }, Impairment{ Drop : 0.2, Seed : 4 }, 1024, 8 },
+        { "duplicates", Impairment{ Dup : 0.3, Seed : 5 }, Impairment{ Dup : 0.3, Seed : 6 }, tftp.BlockSize, 4 },
+        { "reordering", Impairment{ Reorder : 0.2, Delay : time.Millisecond, Jitter : 5 * time.Millisecond, Seed : 7 },
+            Impairment{ Reorder : 0.2, Jitter : 5 * time.Millisecond, Seed : 8 }, tftp.BlockSize, 8 },
+        { "everything", Impairment{ Drop : 0.1, Dup : 0.1, Reorder : 0.1, Jitter : 2 * time.Millisecond, Seed : 9 },
+            Impairment{ Drop : 0.1, Dup : 0.1, Reorder : 0.1, Seed : 10 }, 512, 16 },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            set_server_impairment(&tt.server)
+            c := test_client(t)
+            c.Timeout = 50 * time.Millisecond
+            c.Retries = 20
+            c.Blksize = tt.blksize
+            c.Windowsize = tt.windowsize
+            c.Wrap = impair_client(&tt.client)
+            content := random_content(6, 40 * 1024 + 17)
+            round_trip(t, c, "impaired/" + tt.name, content)
+            if tt.client.Drop > 0 && c.Retransmits() == 0 {
+                t.Errorf("nothing retransmitted with %s", tt.client.String())
+            }
+        })
+    }
+}
@@ -0,0 +1,107 @@
+package main
+
+import(
+    "flag"
+    "sync"
+    "time"
+)
+
+// ---------------------------------
+// Rate Limiting And Session Caps
+// ---------------------------------
+// Applied in the control loop before a session is spawned :
+// - a token bucket per source IP limits the rate of new requests
+// - the number of concurrent sessions is capped per source IP and globally
+// Sessions hold their slot until they finish or time out ( -session-timeout )
+var requestRate = flag.Float64("rate", 0, "new requests per second allowed per source IP, 0 disables")
+var requestBurst = flag.Int("burst", 10, "burst of new requests allowed per source IP above -rate")
+var maxClientSessions = flag.Int("max-client-sessions", 0, "max concurrent sessions per source IP, 0 is unlimited")
+var maxSessions = flag.Int("max-sessions", 0, "max concurrent sessions for the whole server, 0 is unlimited")
+var sessionTimeout = flag.Duration("session-timeout", 30 * time.Second, "abort a session when the peer stays silent that long")
+
+// buckets which have been idle long enough to be full again are dropped
+const bucket_prune_interval = time.Minute
+
+type TokenBucket struct {
+    tokens float64
+    last time.Time
+}
+
+var limiter = struct {
+    sync.Mutex
+    buckets map[string]*TokenBucket
+    last_prune time.Time
+    client_sessions map[string]int
+    sessions int
+} { buckets : make(map[string]*TokenBucket), client_sessions : make(map[string]int) }
+
+// Takes a token from the bucket of the source, false when it is empty
+func allow_request(ip string) (bool) {
+    if *requestRate <= 0 {
+        return true
+    }
+
+    limiter.Lock()
+    defer limiter.Unlock()
+
+    now := time.Now()
+    if now.Sub(limiter.last_prune) > bucket_prune_interval {
+        prune_buckets(now)
+        limiter.last_prune = now
+    }
+
+    b, ok := limiter.buckets[ip]
+    if ok == false {
+        b = &TokenBucket{ tokens : float64(*requestBurst), last : now }
+        limiter.buckets[ip] = b
+    }
+    b.tokens += now.Sub(b.last).Seconds() * *requestRate
+    if b.tokens > float64(*requestBurst) {
+        b.tokens = float64(*requestBurst)
+    }
+    b.last = now
+
+    if b.tokens < 1 {
+        return false
+    }
+    b.tokens--
+    return true
+}
+
+// Must be called with the limiter lock held
+func prune_buckets(now time.Time) {
+    full := time.Duration(float64(*requestBurst) / *requestRate * float64(time.Second))
+    for ip, b := range limiter.buckets {
+        if now.Sub(b.last) > full {
+            delete(limiter.buckets, ip)
+        }
+    }
+}
+
+// Reserves a session slot for the source, returns the reason when a cap is
+// reached. Every successful call must be paired with release_session
+func acquire_session(ip string) (ok bool, reason string) {
+    limiter.Lock()
+    defer limiter.Unlock()
+
+    if *maxSessions > 0 && limiter.sessions >= *maxSessions {
+        return false, "Too many sessions on the server, please retry later"
+    }
+    if *maxClientSessions > 0 && limiter.client_sessions[ip] >= *maxClientSessions {
+        return false, "Too many sessions from your address, please retry later"
+    }
+    limiter.sessions++
+    limiter.client_sessions[ip]++
+    return true, ""
+}
+
+func release_session(ip string) {
+    limiter.Lock()
+    defer limiter.Unlock()
+
+    limiter.sessions--
+    limiter.client_sessions[ip]--
+    if limiter.client_sessions[ip] <= 0 {
+        delete(limiter.client_sessions, ip)
+    }
+}
@@ -0,0 +1,265 @@
+package main
+
+import(
+    "bufio"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "os/signal"
+    "strings"
+    "sync/atomic"
+    "unicode"
+)
+
+// ---------------------------------
+// Line Editing
+// ---------------------------------
+// The shell prompt on a terminal, in raw mode while a line is entered :
+// - left / right ( ^B / ^F ), home / end ( ^A / ^E ) move the cursor
+// - backspace, delete ( ^D ), ^K to the end, ^U to the start and ^W the word
+//   before the cursor delete
+// - up / down ( ^P / ^N ) recall the lines of the history, an edited recall
+//   is entered as a new line
+// - ^C discards the line, ^D on an empty line ends the input, ^L clears the
+//   screen
+// Raw mode is set and undone with stty(1), the terminal is back in its own
+// mode while a command runs so ^C then interrupts the transfer. Where stty is
+// not available lines are read as the terminal delivers them, and ^C only
+// brings the prompt back
+type LineEditor struct {
+    in *bufio.Reader
+    out io.Writer
+    tty *os.File
+    at_prompt atomic.Bool
+    prompt string
+}
+
+func new_line_editor(in *os.File, out io.Writer) (ed *LineEditor) {
+    ed = new(LineEditor)
+    ed.in = bufio.NewReader(in)
+    ed.out = out
+    ed.tty = in
+    return ed
+}
+
+// Puts the terminal in raw mode : no echo, no line buffering and ^C read as a
+// character. Output processing is left alone. Returns how to put it back
+func make_raw(tty *os.File) (restore func(), err error) {
+    saved, err := stty(tty, "-g")
+    if err != nil {
+        return nil, err
+    }
+    _, err = stty(tty, "-icanon", "-echo", "-isig", "-iexten", "-icrnl", "-inlcr", "-igncr", "-ixon", "min", "1", "time", "0")
+    if err != nil {
+        return nil, err
+    }
+    return func() {
+        stty(tty, strings.TrimSpace(saved))
+    }, nil
+}
+
+func stty(tty *os.File, args ...string) (string, error) {
+    cmd := exec.Command("stty", args...)
+    cmd.Stdin = tty
+    out, err := cmd.Output()
+    return string(out), err
+}
+
+// Keeps an interrupt from ending the shell, at the prompt the line typed so
+// far is dropped by the terminal and the prompt shown again. Transfers catch
+// interrupts on their own
+func (ed *LineEditor) catch_interrupts() (stop func()) {
+    interrupts := make(chan os.Signal, 1)
+    signal.Notify(interrupts, os.Interrupt)
+    go func() {
+        for range interrupts {
+            if ed.at_prompt.Load() == true {
+                fmt.Fprintf(ed.out, "^C\n%s", ed.prompt)
+            }
+        }
+    }()
+    return func() {
+        signal.Stop(interrupts)
+        close(interrupts)
+    }
+}
+
+// Reads a line after showing prompt, history is what up and down recall. The
+// error is io.EOF at the end of the input
+func (ed *LineEditor) read_line(prompt string, history []string) (string, error) {
+    ed.prompt = prompt
+    ed.at_prompt.Store(true)
+    defer ed.at_prompt.Store(false)
+
+    restore, err := make_raw(ed.tty)
+    if err != nil {
+        fmt.Fprintf(ed.out, "%s", prompt)
+        line, err := ed.in.ReadString('\n')
+        if err == io.EOF && line != "" {
+            err = nil
+        }
+        return strings.TrimRight(line, "\r\n"), err
+    }
+    defer restore()
+    fmt.Fprintf(ed.out, "%s", prompt)
+    return ed.edit(history)
+}
+
+// The state of the line being edited, recalled is the entry of the history
+// shown, len(history) for the line being typed which draft keeps meanwhile
+type line_state struct {
+    buf []rune
+    pos int
+    recalled int
+    draft []rune
+}
+
+func (ed *LineEditor) edit(history []string) (string, error) {
+    st := &line_state{ recalled : len(history) }
+    for {
+        r, _, err := ed.in.ReadRune()
+        if err != nil {
+            if err == io.EOF && len(st.buf) > 0 {
+                fmt.Fprintf(ed.out, "\r\n")
+                return string(st.buf), nil
+            }
+            return "", err
+        }
+        switch r {
+        case '\r', '\n':
+            fmt.Fprintf(ed.out, "\r\n")
+            return string(st.buf), nil
+        case 0x03:
+            // ^C, start over on a fresh line
+            fmt.Fprintf(ed.out, "^C\r\n")
+            st = &line_state{ recalled : len(history) }
+        case 0x04:
+            if len(st.buf) == 0 {
+                return "", io.EOF
+            }
+            st.delete(st.pos, st.pos + 1)
+        case 0x7f, 0x08:
+            st.delete(st.pos - 1, st.pos)
+        case 0x01:
+            st.pos = 0
+        case 0x05:
+            st.pos = len(st.buf)
+        case 0x02:
+            st.pos = max(st.pos - 1, 0)
+        case 0x06:
+            st.pos = min(st.pos + 1, len(st.buf))
+        case 0x0b:
+            st.delete(st.pos, len(st.buf))
+        case 0x15:
+            st.delete(0, st.pos)
+        case 0x17:
+            st.delete(word_start(st.buf, st.pos), st.pos)
+        case 0x10:
+            st.recall(history, st.recalled - 1)
+        case 0x0e:
+            st.recall(history, st.recalled + 1)
+        case 0x0c:
+            fmt.Fprintf(ed.out, "\x1b[H\x1b[2J")
+        case 0x1b:
+            ed.escape(st, history)
+        default:
+            if unicode.IsPrint(r) == true {
+                st.insert(r)
+            }
+        }
+        ed.refresh(st)
+    }
+}
+
+// Handles the escape sequences of the arrow, home, end and delete keys, any
+// other is skipped
+func (ed *LineEditor) escape(st *line_state, history []string) {
+    r, _, err := ed.in.ReadRune()
+    if err != nil || (r != '[' && r != 'O') {
+        return
+    }
+    seq := ""
+    for {
+        r, _, err = ed.in.ReadRune()
+        if err != nil {
+            return
+        }
+        seq += string(r)
+        if r < '0' || r > '9' {
+            break
+        }
+    }
+    switch seq {
+    case "A":
+        st.recall(history, st.recalled - 1)
+    case "B":
+        st.recall(history, st.recalled + 1)
+    case "C":
+        st.pos = min(st.pos + 1, len(st.buf))
+    case "D":
+        st.pos = max(st.pos - 1, 0)
+    case "H", "1~", "7~":
+        st.pos = 0
+    case "F", "4~", "8~":
+        st.pos = len(st.buf)
+    case "3~":
+        st.delete(st.pos, st.pos + 1)
+    }
+}
+
+// Draws the line again, with the cursor where it is in the line
+func (ed *LineEditor) refresh(st *line_state) {
+    fmt.Fprintf(ed.out, "\r%s%s\x1b[K", ed.prompt, string(st.buf))
+    if n := len(st.buf) - st.pos; n > 0 {
+        fmt.Fprintf(ed.out, "\x1b[%dD", n)
+    }
+}
+
+func (st *line_state) insert(r rune) {
+    st.buf = append(st.buf[0:st.pos], append([]rune{ r }, st.buf[st.pos:]...)...)
+    st.pos++
+}
+
+// Deletes the runes from..to, clipped to the line
+func (st *line_state) delete(from int, to int) {
+    from, to = max(from, 0), min(to, len(st.buf))
+    if from >= to {
+        return
+    }
+    st.buf = append(st.buf[0:from], st.buf[to:]...)
+    if st.pos > to {
+        st.pos -= to - from
+    } else if st.pos > from {
+        st.pos = from
+    }
+}
+
+// Shows entry i of the history, len(history) being the line typed
+func (st *line_state) recall(history []string, i int) {
+    if i < 0 || i > len(history) || i == st.recalled {
+        return
+    }
+    if st.recalled == len(history) {
+        st.draft = st.buf
+    }
+    st.recalled = i
+    if i == len(history) {
+        st.buf = st.draft
+    } else {
+        st.buf = []rune(history[i])
+    }
+    st.pos = len(st.buf)
+}
+
+// Where the word before pos starts, blanks before it included
+func word_start(buf []rune, pos int) (int) {
+    i := pos
+    for i > 0 && buf[i - 1] == ' ' {
+        i--
+    }
+    for i > 0 && buf[i - 1] != ' ' {
+        i--
+    }
+    return i
+}
@@ -0,0 +1,46 @@
+package main
+
+import(
+    "bufio"
+    "io"
+    "strings"
+    "testing"
+)
+
+func TestLineEditor(t *testing.T) {
+    history := []string{ "get a", "put b c" }
+    tests := []struct {
+        name string
+        keys string
+        want string
+        err error
+    }{
+        { "typed", "status\r", "status", nil },
+        { "backspace", "statuss\x7f\r", "status", nil },
+        { "insert", "sttus\x1b[D\x1b[D\x1b[Da\r", "status", nil },
+        { "home end", "tatu\x01s\x05s\r", "status", nil },
+        { "delete", "sXtatus\x01\x1b[C\x1b[3~\r", "status", nil },
+        { "kill", "status foo\x1b[D\x1b[D\x1b[D\x1b[D\x0b\r", "status", nil },
+        { "kill start", "foo status\x1b[D\x1b[D\x1b[D\x1b[D\x1b[D\x1b[D\x15\r", "status", nil },
+        { "word", "get some file\x17\x17\r", "get ", nil },
+        { "up", "\x1b[A\r", "put b c", nil },
+        { "up twice", "\x1b[A\x1b[A\r", "get a", nil },
+        { "past oldest", "\x1b[A\x1b[A\x1b[A\r", "get a", nil },
+        { "back to draft", "ver\x1b[A\x1b[A\x1b[B\x1b[Bbose\r", "verbose", nil },
+        { "edited recall", "\x10\x10\x7fb\r", "get b", nil },
+        { "interrupt", "blksize 8\x03mode\r", "mode", nil },
+        { "eof", "\x04", "", io.EOF },
+        { "eof mid line", "mode\x01\x04\r", "ode", nil },
+        { "unterminated", "mode", "mode", nil },
+        { "unicode", "get fé\x7f\x7fe\r", "get e", nil },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ed := &LineEditor{ in : bufio.NewReader(strings.NewReader(tt.keys)), out : io.Discard }
+            got, err := ed.edit(history)
+            if got != tt.want || err != tt.err {
+                t.Errorf("%q : got %q, %v, want %q, %v", tt.keys, got, err, tt.want, tt.err)
+            }
+        })
+    }
+}
@@ -0,0 +1,195 @@
+package main
+
+import(
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "sync"
+    "time"
+    "ttftp/tftp"
+)
+
+// ---------------------------------
+// Leveled Structured Logging
+// ---------------------------------
+// Every line has a level, the subsystem it comes from and optional key/value
+// fields such as the session id. Levels from the most to the least severe :
+//
+//   error, warn, info, debug, packet
+//
+// -log-level sets the level for all subsystems, -log-levels overrides it for
+// some ( e.g. "RRQ=debug,SERVER=warn" ). Packet contents are redacted unless
+// -log-payloads is set. Lines go to -log-file as text or JSON ( -log-format )
+const(
+    level_error int = tftp.LogError
+    level_warn int = tftp.LogWarn
+    level_info int = tftp.LogInfo
+    level_debug int = tftp.LogDebug
+    level_packet int = tftp.LogPacket
+)
+
+var level_names = []string{ "error", "warn", "info", "debug", "packet" }
+
+var logLevel = flag.String("log-level", "info", "log level : error | warn | info | debug | packet")
+var logLevels = flag.String("log-levels", "", "per subsystem log levels, e.g. RRQ=debug,SERVER=warn")
+var logFormat = flag.String("log-format", "text", "log format : text | json")
+var logFile = flag.String("log-file", "stderr", "log sink : stderr | stdout | path of a file to append to")
+var logPayloads = flag.Bool("log-payloads", false, "include packet and file contents in packet level logs")
+
+var logging = struct {
+    sync.Mutex
+    out io.Writer
+    json bool
+    level int
+    levels map[string]int
+} { out : os.Stderr, level : level_info, levels : make(map[string]int) }
+
+func parse_level(name string) (int, error) {
+    for level, n := range level_names {
+        if n == strings.ToLower(name) {
+            return level, nil
+        }
+    }
+    return 0, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(level_names, " | "))
+}
+
+func setup_logging() (error) {
+    level, err := parse_level(*logLevel)
+    if err != nil {
+        return err
+    }
+    levels := make(map[string]int)
+    for _, pair := range strings.Split(*logLevels, ",") {
+        if strings.TrimSpace(pair) == "" {
+            continue
+        }
+        kv := strings.SplitN(pair, "=", 2)
+        if len(kv) != 2 {
+            return fmt.Errorf("bad -log-levels entry %q, expected SUBSYSTEM=level", pair)
+        }
+        l, err := parse_level(strings.TrimSpace(kv[1]))
+        if err != nil {
+            return err
+        }
+        levels[strings.ToUpper(strings.TrimSpace(kv[0]))] = l
+    }
+    if *logFormat != "text" && *logFormat != "json" {
+        return fmt.Errorf("unknown log format %q", *logFormat)
+    }
+
+    var out io.Writer
+    if *logFile == "stderr" {
+        out = os.Stderr
+    } else if *logFile == "stdout" {
+        out = os.Stdout
+    } else {
+        f, err := os.OpenFile(*logFile, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+        if err != nil {
+            return err
+        }
+        out = f
+    }
+
+    logging.Lock()
+    logging.out = out
+    logging.json = *logFormat == "json"
+    logging.level = level
+    logging.levels = levels
+    logging.Unlock()
+    return nil
+}
+
+type Logger struct {
+    subsys string
+    fields []interface{}
+}
+
+func new_logger(subsys string) (l *Logger) {
+    return &Logger{ subsys : subsys }
+}
+
+// Returns a logger which adds key=value to every line
+func (l *Logger) with(key string, value interface{}) (*Logger) {
+    fields := make([]interface{}, len(l.fields), len(l.fields) + 2)
+    copy(fields, l.fields)
+    return &Logger{ subsys : l.subsys, fields : append(fields, key, value) }
+}
+
+// Whether lines of level are logged, and in JSON. Read under the lock as
+// setup_logging may change them at any time
+func (l *Logger) enabled(level int) (enabled bool, json bool) {
+    logging.Lock()
+    defer logging.Unlock()
+
+    max, ok := logging.levels[l.subsys]
+    if ok == false {
+        max = logging.level
+    }
+    return level <= max, logging.json
+}
+
+func (l *Logger) errorf(format string, v ...interface{}) { l.logf(level_error, format, v...) }
+func (l *Logger) warnf(format string, v ...interface{}) { l.logf(level_warn, format, v...) }
+func (l *Logger) infof(format string, v ...interface{}) { l.logf(level_info, format, v...) }
+func (l *Logger) debugf(format string, v ...interface{}) { l.logf(level_debug, format, v...) }
+func (l *Logger) packetf(format string, v ...interface{}) { l.logf(level_packet, format, v...) }
+
+func (l *Logger) logf(level int, format string, v ...interface{}) {
+    enabled, json_format := l.enabled(level)
+    if enabled == false {
+        return
+    }
+    now := time.Now().UTC()
+    msg := fmt.Sprintf(format, v...)
+
+    var line []byte
+    if json_format == true {
+        entry := make(map[string]interface{}, 4 + len(l.fields) / 2)
+        for i := 0; i + 1 < len(l.fields); i += 2 {
+            entry[fmt.Sprint(l.fields[i])] = l.fields[i + 1]
+        }
+        entry["time"] = now.Format(time.RFC3339Nano)
+        entry["level"] = level_names[level]
+        entry["subsys"] = l.subsys
+        entry["msg"] = msg
+        buf := new(bytes.Buffer)
+        enc := json.NewEncoder(buf)
+        enc.SetEscapeHTML(false)
+        enc.Encode(entry)
+        line = buf.Bytes()
+    } else {
+        buf := make([]byte, 0, 128)
+        buf = append(buf, now.Format("2006-01-02T15:04:05.000Z")...)
+        buf = append(buf, fmt.Sprintf(" %-6s [%s]", strings.ToUpper(level_names[level]), l.subsys)...)
+        for i := 0; i + 1 < len(l.fields); i += 2 {
+            buf = append(buf, fmt.Sprintf(" %v=%v", l.fields[i], l.fields[i + 1])...)
+        }
+        buf = append(buf, ' ')
+        buf = append(buf, msg...)
+        line = append(buf, '\n')
+    }
+
+    logging.Lock()
+    logging.out.Write(line)
+    logging.Unlock()
+}
+
+// Packet or file contents for a log line, redacted by default. Only rendered
+// when the line is formatted, that is when its level is enabled
+type Payload []byte
+
+func payload(b []byte) (Payload) {
+    return Payload(b)
+}
+
+func (p Payload) String() (string) {
+    if *logPayloads == false {
+        return fmt.Sprintf("<redacted %d bytes>", len(p))
+    }
+    return base64.URLEncoding.EncodeToString(p)
+}
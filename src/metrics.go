@@ -0,0 +1,288 @@
+package main
+
+import(
+    "bufio"
+    "flag"
+    "fmt"
+    "io"
+    "math"
+    "net"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// ---------------------------------
+// Prometheus Metrics
+// ---------------------------------
+// Counters and histograms in the Prometheus text exposition format, served on
+// /metrics of the HTTP admin API and, with -metrics-addr, on a listener of
+// their own. Gauges are computed when scraped
+var metricsAddr = flag.String("metrics-addr", "", "address of a dedicated /metrics listener, empty disables")
+
+var metrics_log = new_logger("METRICS")
+
+type MetricWriter interface {
+    write_metric(w io.Writer)
+}
+
+var all_metrics []MetricWriter
+
+// A counter family, one value per combination of label values
+type CounterVec struct {
+    sync.Mutex
+    name string
+    help string
+    labels []string
+    values map[string]float64
+}
+
+type HistogramSeries struct {
+    counts []uint64
+    sum float64
+    count uint64
+}
+
+// A histogram family, one series per combination of label values
+type HistogramVec struct {
+    sync.Mutex
+    name string
+    help string
+    labels []string
+    buckets []float64
+    series map[string]*HistogramSeries
+}
+
+type Sample struct {
+    label_values []string
+    value float64
+}
+
+// A gauge ( or counter ) family whose samples are computed at scrape time
+type GaugeFunc struct {
+    name string
+    help string
+    typ string
+    labels []string
+    collect func() []Sample
+}
+
+func new_counter(name string, help string, labels ...string) (c *CounterVec) {
+    c = &CounterVec{ name : name, help : help, labels : labels, values : make(map[string]float64) }
+    all_metrics = append(all_metrics, c)
+    return c
+}
+
+func new_histogram(name string, help string, buckets []float64, labels ...string) (h *HistogramVec) {
+    h = &HistogramVec{ name : name, help : help, labels : labels, buckets : buckets, series : make(map[string]*HistogramSeries) }
+    all_metrics = append(all_metrics, h)
+    return h
+}
+
+func new_gauge_func(name string, help string, collect func() []Sample, labels ...string) (g *GaugeFunc) {
+    g = &GaugeFunc{ name : name, help : help, typ : "gauge", labels : labels, collect : collect }
+    all_metrics = append(all_metrics, g)
+    return g
+}
+
+func new_counter_func(name string, help string, collect func() []Sample, labels ...string) (g *GaugeFunc) {
+    g = new_gauge_func(name, help, collect, labels...)
+    g.typ = "counter"
+    return g
+}
+
+// label values are joined with a byte which never shows up in them
+func series_key(label_values []string) (string) {
+    return strings.Join(label_values, "\xff")
+}
+
+func series_values(key string) ([]string) {
+    return strings.Split(key, "\xff")
+}
+
+func (c *CounterVec) add(delta float64, label_values ...string) {
+    c.Lock()
+    c.values[series_key(label_values)] += delta
+    c.Unlock()
+}
+
+func (c *CounterVec) inc(label_values ...string) {
+    c.add(1, label_values...)
+}
+
+func (h *HistogramVec) observe(v float64, label_values ...string) {
+    key := series_key(label_values)
+
+    h.Lock()
+    defer h.Unlock()
+
+    s, ok := h.series[key]
+    if ok == false {
+        s = &HistogramSeries{ counts : make([]uint64, len(h.buckets)) }
+        h.series[key] = s
+    }
+    for i, le := range h.buckets {
+        if v <= le {
+            s.counts[i]++
+        }
+    }
+    s.sum += v
+    s.count++
+}
+
+func escape_label(v string) (string) {
+    v = strings.Replace(v, "\\", "\\\\", -1)
+    v = strings.Replace(v, "\"", "\\\"", -1)
+    return strings.Replace(v, "\n", "\\n", -1)
+}
+
+func format_labels(names []string, values []string, extra ...string) (string) {
+    pairs := make([]string, 0, len(names) + 1)
+    for i, name := range names {
+        pairs = append(pairs, name + "=\"" + escape_label(values[i]) + "\"")
+    }
+    for i := 0; i + 1 < len(extra); i += 2 {
+        pairs = append(pairs, extra[i] + "=\"" + escape_label(extra[i + 1]) + "\"")
+    }
+    if len(pairs) == 0 {
+        return ""
+    }
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func format_value(v float64) (string) {
+    if math.IsInf(v, 1) {
+        return "+Inf"
+    }
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sorted_keys(m interface{}) (keys []string) {
+    if values, ok := m.(map[string]float64); ok {
+        for k := range values {
+            keys = append(keys, k)
+        }
+    } else if series, ok := m.(map[string]*HistogramSeries); ok {
+        for k := range series {
+            keys = append(keys, k)
+        }
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+func (c *CounterVec) write_metric(w io.Writer) {
+    c.Lock()
+    defer c.Unlock()
+
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+    for _, key := range sorted_keys(c.values) {
+        fmt.Fprintf(w, "%s%s %s\n", c.name, format_labels(c.labels, series_values(key)), format_value(c.values[key]))
+    }
+}
+
+func (h *HistogramVec) write_metric(w io.Writer) {
+    h.Lock()
+    defer h.Unlock()
+
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+    for _, key := range sorted_keys(h.series) {
+        s := h.series[key]
+        values := series_values(key)
+        for i, le := range h.buckets {
+            fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, format_labels(h.labels, values, "le", format_value(le)), s.counts[i])
+        }
+        fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, format_labels(h.labels, values, "le", "+Inf"), s.count)
+        fmt.Fprintf(w, "%s_sum%s %s\n", h.name, format_labels(h.labels, values), format_value(s.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", h.name, format_labels(h.labels, values), s.count)
+    }
+}
+
+func (g *GaugeFunc) write_metric(w io.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", g.name, g.help, g.name, g.typ)
+    for _, sample := range g.collect() {
+        fmt.Fprintf(w, "%s%s %s\n", g.name, format_labels(g.labels, sample.label_values), format_value(sample.value))
+    }
+}
+
+func write_metrics(w io.Writer) {
+    for _, m := range all_metrics {
+        m.write_metric(w)
+    }
+}
+
+func http_metrics(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    bw := bufio.NewWriter(w)
+    write_metrics(bw)
+    bw.Flush()
+}
+
+func start_metrics(addr string) (error) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", http_metrics)
+
+    ln, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    metrics_log.infof("Listening on %s", addr)
+    go http.Serve(ln, mux)
+    return nil
+}
+
+// ---------------------------------
+// Instrumentation
+// ---------------------------------
+var metric_requests = new_counter("ttftp_requests_total", "RRQ/WRQ received by the control loop by outcome", "opcode", "outcome")
+var metric_sessions = new_counter("ttftp_sessions_total", "Finished sessions by outcome", "type", "outcome")
+var metric_session_duration = new_histogram("ttftp_session_duration_seconds", "Duration of finished sessions",
+    []float64{ 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300 }, "type")
+var metric_bytes_sent = new_counter("ttftp_bytes_sent_total", "Bytes sent by sessions, headers included", "type")
+var metric_bytes_received = new_counter("ttftp_bytes_received_total", "Bytes received by sessions, headers included", "type")
+var metric_retransmissions = new_counter("ttftp_retransmissions_total", "Packets retransmitted by sessions", "type")
+var metric_errors = new_counter("ttftp_errors_total", "ERROR packets by code and direction", "code", "direction")
+var metric_store_ops = new_counter("ttftp_store_operations_total", "File store operations", "op", "result")
+
+var metric_active_sessions = new_gauge_func("ttftp_active_sessions", "Sessions currently running", func() ([]Sample) {
+    active := map[string]float64{ "RRQ" : 0, "WRQ" : 0 }
+    for _, info := range list_sessions() {
+        active[info.Type]++
+    }
+    return []Sample{ { []string{ "RRQ" }, active["RRQ"] }, { []string{ "WRQ" }, active["WRQ"] } }
+}, "type")
+
+var metric_store_keys = new_gauge_func("ttftp_store_keys", "Keys in the file store", func() ([]Sample) {
+    keys, _, _ := store_stats()
+    return []Sample{ { nil, float64(keys) } }
+})
+
+var metric_store_bytes = new_gauge_func("ttftp_store_bytes", "Bytes in the file store, logical ( sum of file sizes ) and physical ( held in memory )", func() ([]Sample) {
+    _, logical_bytes, physical_bytes := store_stats()
+    return []Sample{ { []string{ "logical" }, float64(logical_bytes) }, { []string{ "physical" }, float64(physical_bytes) } }
+}, "kind")
+
+var metric_partial_uploads = new_gauge_func("ttftp_partial_uploads", "Partial uploads kept for their clients to resume, count and bytes", func() ([]Sample) {
+    n, bytes := partial_stats()
+    return []Sample{ { []string{ "count" }, float64(n) }, { []string{ "bytes" }, float64(bytes) } }
+}, "kind")
+
+var metric_events = new_counter_func("ttftp_events_total", "Internal event counters ( see the counters admin command )", func() ([]Sample) {
+    snapshot := counter_snapshot()
+    samples := make([]Sample, 0, len(snapshot))
+    for name, v := range snapshot {
+        samples = append(samples, Sample{ []string{ name }, float64(v) })
+    }
+    sort.Slice(samples, func(i, j int) bool { return samples[i].label_values[0] < samples[j].label_values[0] })
+    return samples
+}, "name")
+
+func opcode_name(opcode uint16) (string) {
+    names := []string{ "", "WRQ", "RRQ", "DATA", "ACK", "ERROR", "OACK" }
+    if int(opcode) < len(names) && opcode > 0 {
+        return names[opcode]
+    }
+    return "UNKNOWN"
+}
@@ -0,0 +1,121 @@
+package main
+
+import(
+    "flag"
+    "net"
+    "sync"
+    "time"
+    "ttftp/tftp"
+)
+
+// ---------------------------------
+// Resumable Uploads
+// ---------------------------------
+// A WRQ may carry a non-standard token option, an opaque string the client
+// picks for one upload of one file. When the session fails the blocks
+// received so far are kept under the token for -upload-grace, and a later
+// WRQ for the same key, from the same IP and with the same token picks them
+// up : the OACK tells the client the offset to go on from, block 1 of the
+// new session carries the bytes from there. Uploads are kept per token, key
+// and IP, so a peer reusing another one's token neither takes nor replaces
+// its upload. Kept uploads live outside the store, readers never see them, the file is only stored once complete.
+// -upload-grace-bytes bounds the memory held by kept uploads
+var uploadGrace = flag.Duration("upload-grace", 0, "how long partial uploads with a token are kept for the client to resume, 0 disables")
+var uploadGraceBytes = flag.Int("upload-grace-bytes", 1024 * 1024 * 1024, "bytes of partial uploads kept at most")
+
+// Tokens are short printable strings
+const max_token_len int = 64
+
+// What a kept upload is found by
+type partial_id struct {
+    token string
+    key string
+    ip string
+}
+
+type PartialUpload struct {
+    file *FileWriter
+    timer *time.Timer
+}
+
+var partials = struct {
+    sync.Mutex
+    m map[partial_id]*PartialUpload
+    bytes int
+} { m : make(map[partial_id]*PartialUpload) }
+
+// Returns the token of a WRQ, empty when it has none, a bad one or
+// resumable uploads are disabled
+func upload_token(m *tftp.Message) (string) {
+    token, ok := m.Options["token"]
+    if ok == false || *uploadGrace <= 0 || len(token) == 0 || len(token) > max_token_len {
+        return ""
+    }
+    for _, c := range token {
+        if c <= ' ' || c > '~' {
+            return ""
+        }
+    }
+    return token
+}
+
+// Keeps what a failed upload received for the client to resume
+func retain_partial(token string, key string, ip net.IP, file *FileWriter) {
+    id := partial_id{ token, key, ip.String() }
+    partials.Lock()
+    defer partials.Unlock()
+    if old, ok := partials.m[id]; ok == true {
+        drop_partial(id, old)
+    }
+    if file.sz == 0 {
+        return
+    }
+    if partials.bytes + file.sz > *uploadGraceBytes {
+        wrq_log.warnf("Not keeping partial upload of %d bytes, Key=%s : -upload-grace-bytes reached", file.sz, key)
+        count("partial_upload_refused")
+        return
+    }
+
+    p := &PartialUpload{ file : file }
+    p.timer = time.AfterFunc(*uploadGrace, func() {
+        partials.Lock()
+        defer partials.Unlock()
+        if partials.m[id] == p {
+            wrq_log.infof("Partial upload expired, Key=%s, Size=%d", key, file.sz)
+            count("partial_upload_expired")
+            drop_partial(id, p)
+        }
+    })
+    partials.m[id] = p
+    partials.bytes += file.sz
+    count("partial_upload_kept")
+    wrq_log.infof("Keeping partial upload for %s, Key=%s, Size=%d", *uploadGrace, key, file.sz)
+}
+
+// Takes back the partial upload of token, nil when there is none for this
+// key and IP. The upload goes on in the session, nobody else can take it
+func take_partial(token string, key string, ip net.IP) (file *FileWriter) {
+    id := partial_id{ token, key, ip.String() }
+    partials.Lock()
+    defer partials.Unlock()
+    p, ok := partials.m[id]
+    if ok == false {
+        return nil
+    }
+    drop_partial(id, p)
+    count("partial_upload_resumed")
+    return p.file
+}
+
+// Caller holds the lock
+func drop_partial(id partial_id, p *PartialUpload) {
+    p.timer.Stop()
+    delete(partials.m, id)
+    partials.bytes -= p.file.sz
+}
+
+func partial_stats() (n int, bytes int) {
+    partials.Lock()
+    defer partials.Unlock()
+    return len(partials.m), partials.bytes
+}
@@ -0,0 +1,273 @@
+package main
+
+import(
+    "encoding/binary"
+    "flag"
+    "fmt"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// ---------------------------------
+// Packet Capture ( pcap )
+// ---------------------------------
+// With -pcap every packet received or sent on the control socket and the
+// session sockets is written to a classic pcap file. Records use
+// LINKTYPE_RAW : an IPv4 or IPv6 header and a UDP header are synthesized from
+// the socket and peer addresses, which carry the direction of the packet,
+// followed by the TFTP packet itself. Session sockets listen on the wildcard
+// address, their source address is taken from the control socket instead so
+// that Wireshark ties sessions to their request.
+//
+// Wireshark only dissects UDP port 69 as TFTP by default, add the control
+// port to the TFTP port range preference ( or use Decode As ).
+//
+// -pcap-client and -pcap-key restrict the capture to some peers or keys,
+// packets on the control socket which do not decode have no key. Once a file
+// reaches -pcap-max-size it is rotated to <file>.1, <file>.2 ... keeping
+// -pcap-files of them
+var pcapFile = flag.String("pcap", "", "file to capture packets to in pcap format, empty disables")
+var pcapClient = flag.String("pcap-client", "", "comma separated CIDRs or addresses to capture, empty captures every peer")
+var pcapKey = flag.String("pcap-key", "", "key pattern to capture ( prefix/ or glob ), empty captures every key")
+var pcapMaxSize = flag.Int("pcap-max-size", 64 * 1024 * 1024, "bytes after which the capture file is rotated, 0 never rotates")
+var pcapFiles = flag.Int("pcap-files", 5, "rotated capture files to keep")
+
+const(
+    pcap_magic uint32 = 0xa1b2c3d4
+    pcap_snaplen uint32 = 65535
+    linktype_raw uint32 = 101
+    ipv4_header_bytes int = 20
+    ipv6_header_bytes int = 40
+    udp_header_bytes int = 8
+)
+
+var capture = struct {
+    sync.Mutex
+    f *os.File
+    sz int64
+    clients []*net.IPNet
+    local_ip net.IP
+} {}
+
+var pcap_log = new_logger("PCAP")
+
+// Opens the capture file, local is the address of the control socket
+func start_capture(filename string, local *net.UDPAddr) (error) {
+    var clients []*net.IPNet
+    for _, cidr := range strings.Split(*pcapClient, ",") {
+        cidr = strings.TrimSpace(cidr)
+        if cidr == "" {
+            continue
+        }
+        if strings.Contains(cidr, "/") == false {
+            if strings.Contains(cidr, ":") {
+                cidr += "/128"
+            } else {
+                cidr += "/32"
+            }
+        }
+        _, network, err := net.ParseCIDR(cidr)
+        if err != nil {
+            return fmt.Errorf("pcap-client : %s", err.Error())
+        }
+        clients = append(clients, network)
+    }
+
+    capture.Lock()
+    defer capture.Unlock()
+    capture.clients = clients
+    capture.local_ip = local.IP
+    if err := open_capture_file(filename); err != nil {
+        return err
+    }
+    pcap_log.infof("Capturing packets to %s", filename)
+    return nil
+}
+
+// Must be called with the capture lock held
+func open_capture_file(filename string) (error) {
+    f, err := os.OpenFile(filename, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+    header := make([]byte, 24)
+    binary.LittleEndian.PutUint32(header[0:], pcap_magic)
+    binary.LittleEndian.PutUint16(header[4:], 2)
+    binary.LittleEndian.PutUint16(header[6:], 4)
+    binary.LittleEndian.PutUint32(header[16:], pcap_snaplen)
+    binary.LittleEndian.PutUint32(header[20:], linktype_raw)
+    if _, err := f.Write(header); err != nil {
+        f.Close()
+        return err
+    }
+    capture.f = f
+    capture.sz = int64(len(header))
+    return nil
+}
+
+// Must be called with the capture lock held
+func rotate_capture_file(filename string) (error) {
+    capture.f.Close()
+    capture.f = nil
+    for i := *pcapFiles - 1; i > 0; i-- {
+        os.Rename(fmt.Sprintf("%s.%d", filename, i), fmt.Sprintf("%s.%d", filename, i + 1))
+    }
+    if *pcapFiles > 0 {
+        os.Rename(filename, filename + ".1")
+    }
+    return open_capture_file(filename)
+}
+
+// Records a packet exchanged between a local socket and a peer, in is true
+// for received packets. key is the key of the request or session, if any
+func capture_packet(local *net.UDPAddr, peer *net.UDPAddr, in bool, key string, packet []byte) {
+    if *pcapFile == "" {
+        return
+    }
+    if *pcapKey != "" && match_key(*pcapKey, key) == false {
+        return
+    }
+
+    capture.Lock()
+    defer capture.Unlock()
+    if capture.f == nil {
+        return
+    }
+    if len(capture.clients) > 0 {
+        found := false
+        for _, network := range capture.clients {
+            if network.Contains(peer.IP) {
+                found = true
+                break
+            }
+        }
+        if found == false {
+            return
+        }
+    }
+
+    local_ip := local.IP
+    if local_ip == nil || local_ip.IsUnspecified() {
+        local_ip = capture.local_ip
+    }
+    src, dst := &net.UDPAddr{ IP : local_ip, Port : local.Port }, peer
+    if in == true {
+        src, dst = peer, src
+    }
+    frame := ip_udp_frame(src, dst, packet)
+
+    now := time.Now()
+    record := make([]byte, 16, 16 + len(frame))
+    binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+    binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond() / 1000))
+    binary.LittleEndian.PutUint32(record[8:], uint32(len(frame)))
+    binary.LittleEndian.PutUint32(record[12:], uint32(len(frame)))
+    record = append(record, frame...)
+
+    if _, err := capture.f.Write(record); err != nil {
+        pcap_log.errorf("Capture stopped, unable to write %s : %s", *pcapFile, err.Error())
+        capture.f.Close()
+        capture.f = nil
+        return
+    }
+    capture.sz += int64(len(record))
+    if *pcapMaxSize > 0 && capture.sz >= int64(*pcapMaxSize) {
+        if err := rotate_capture_file(*pcapFile); err != nil {
+            pcap_log.errorf("Capture stopped, unable to rotate %s : %s", *pcapFile, err.Error())
+        }
+    }
+}
+
+// Wraps a UDP payload in a synthesized IPv4 or IPv6 header, IPv6 is used as
+// soon as one of the addresses is not an IPv4 address
+func ip_udp_frame(src *net.UDPAddr, dst *net.UDPAddr, payload []byte) ([]byte) {
+    src4, dst4 := src.IP.To4(), dst.IP.To4()
+    if src4 == nil && src.IP.IsUnspecified() == false || dst4 == nil && dst.IP.IsUnspecified() == false {
+        return ipv6_udp_frame(src.IP.To16(), dst.IP.To16(), src.Port, dst.Port, payload)
+    }
+    if src4 == nil {
+        src4 = net.IPv4zero.To4()
+    }
+    if dst4 == nil {
+        dst4 = net.IPv4zero.To4()
+    }
+
+    udp_len := udp_header_bytes + len(payload)
+    frame := make([]byte, ipv4_header_bytes + udp_len)
+    ip := frame[0:ipv4_header_bytes]
+    ip[0] = 0x45
+    binary.BigEndian.PutUint16(ip[2:], uint16(len(frame)))
+    ip[8] = 64
+    ip[9] = 17
+    copy(ip[12:16], src4)
+    copy(ip[16:20], dst4)
+    binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+    pseudo := make([]byte, 12)
+    copy(pseudo[0:4], src4)
+    copy(pseudo[4:8], dst4)
+    pseudo[9] = 17
+    binary.BigEndian.PutUint16(pseudo[10:], uint16(udp_len))
+    write_udp(frame[ipv4_header_bytes:], src.Port, dst.Port, payload, pseudo)
+    return frame
+}
+
+func ipv6_udp_frame(src net.IP, dst net.IP, src_port int, dst_port int, payload []byte) ([]byte) {
+    if src == nil {
+        src = net.IPv6unspecified
+    }
+    if dst == nil {
+        dst = net.IPv6unspecified
+    }
+    udp_len := udp_header_bytes + len(payload)
+    frame := make([]byte, ipv6_header_bytes + udp_len)
+    ip := frame[0:ipv6_header_bytes]
+    ip[0] = 0x60
+    binary.BigEndian.PutUint16(ip[4:], uint16(udp_len))
+    ip[6] = 17
+    ip[7] = 64
+    copy(ip[8:24], src)
+    copy(ip[24:40], dst)
+
+    pseudo := make([]byte, 40)
+    copy(pseudo[0:16], src)
+    copy(pseudo[16:32], dst)
+    binary.BigEndian.PutUint32(pseudo[32:], uint32(udp_len))
+    pseudo[39] = 17
+    write_udp(frame[ipv6_header_bytes:], src_port, dst_port, payload, pseudo)
+    return frame
+}
+
+func write_udp(udp []byte, src_port int, dst_port int, payload []byte, pseudo []byte) {
+    binary.BigEndian.PutUint16(udp[0:], uint16(src_port))
+    binary.BigEndian.PutUint16(udp[2:], uint16(dst_port))
+    binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+    copy(udp[udp_header_bytes:], payload)
+    sum := checksum(udp, checksum_add(0, pseudo))
+    if sum == 0 {
+        sum = 0xffff
+    }
+    binary.BigEndian.PutUint16(udp[6:], sum)
+}
+
+// Internet checksum ( RFC 1071 ) of b, continuing from a partial sum
+func checksum(b []byte, partial uint32) (uint16) {
+    sum := checksum_add(partial, b)
+    for sum > 0xffff {
+        sum = (sum >> 16) + (sum & 0xffff)
+    }
+    return ^uint16(sum)
+}
+
+func checksum_add(sum uint32, b []byte) (uint32) {
+    for i := 0; i + 1 < len(b); i += 2 {
+        sum += uint32(b[i]) << 8 | uint32(b[i + 1])
+    }
+    if len(b) % 2 == 1 {
+        sum += uint32(b[len(b) - 1]) << 8
+    }
+    return sum
+}
@@ -0,0 +1,157 @@
+package main
+
+import(
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// ---------------------------------
+// Session Registry
+// ---------------------------------
+// Every RRQ/WRQ session registers itself for its lifetime and keeps its entry
+// up to date as it progresses, so what is in flight can be looked at through
+// the admin control channel ( "sessions" ) instead of the trace logs
+type SessionInfo struct {
+    Id uint64 `json:"id"`
+    Type string `json:"type"`
+    Key string `json:"key"`
+    Peer string `json:"peer"`
+    Local string `json:"local"`
+    Bytes int64 `json:"bytes"`
+    Block uint16 `json:"block"`
+    Retransmits int `json:"retransmits"`
+    Start time.Time `json:"start"`
+    State string `json:"state"`
+}
+
+type Session struct {
+    sync.Mutex
+    info SessionInfo
+    cancel func()
+}
+
+var registry_log = new_logger("REGISTRY")
+
+var registry = struct {
+    sync.RWMutex
+    next_id uint64
+    sessions map[uint64]*Session
+} { sessions : make(map[uint64]*Session) }
+
+func init() {
+    admin_commands["sessions"] = AdminCommand{ "sessions", admin_sessions }
+    admin_commands["cancel"] = AdminCommand{ "cancel <session id>", admin_cancel }
+}
+
+func register_session(typ string, key string, peer string, local string) (s *Session) {
+    s = new(Session)
+    s.info.Type = typ
+    s.info.Key = key
+    s.info.Peer = peer
+    s.info.Local = local
+    s.info.Start = time.Now()
+    s.info.State = "starting"
+
+    registry.Lock()
+    registry.next_id++
+    s.info.Id = registry.next_id
+    registry.sessions[s.info.Id] = s
+    registry.Unlock()
+    return s
+}
+
+func unregister_session(s *Session) {
+    registry.Lock()
+    delete(registry.sessions, s.info.Id)
+    registry.Unlock()
+}
+
+func (s *Session) on_cancel(fn func()) {
+    s.Lock()
+    s.cancel = fn
+    s.Unlock()
+}
+
+func cancel_session(id uint64) (error) {
+    registry.RLock()
+    s, ok := registry.sessions[id]
+    registry.RUnlock()
+    if ok == false {
+        return fmt.Errorf("no active session with id %d", id)
+    }
+
+    s.Lock()
+    cancel := s.cancel
+    s.info.State = "cancelled"
+    s.Unlock()
+    if cancel == nil {
+        return fmt.Errorf("session %d cannot be cancelled yet", id)
+    }
+    registry_log.infof("Cancelling session Id=%d", id)
+    cancel()
+    return nil
+}
+
+func (s *Session) set_state(state string) {
+    s.Lock()
+    s.info.State = state
+    s.Unlock()
+}
+
+// Records that a block has been transferred ( sent and acked, or received )
+func (s *Session) progress(block uint16, bytes int) {
+    s.Lock()
+    s.info.Block = block
+    s.info.Bytes += int64(bytes)
+    s.Unlock()
+}
+
+func (s *Session) retransmitted() {
+    s.Lock()
+    s.info.Retransmits++
+    s.Unlock()
+}
+
+func (s *Session) snapshot() (info SessionInfo) {
+    s.Lock()
+    defer s.Unlock()
+    return s.info
+}
+
+// Snapshot of the active sessions, oldest first
+func list_sessions() (infos []SessionInfo) {
+    registry.RLock()
+    infos = make([]SessionInfo, 0, len(registry.sessions))
+    for _, s := range registry.sessions {
+        infos = append(infos, s.snapshot())
+    }
+    registry.RUnlock()
+
+    sort.Slice(infos, func(i, j int) bool { return infos[i].Id < infos[j].Id })
+    return infos
+}
+
+func admin_cancel(args []string, w io.Writer) (error) {
+    if len(args) == 0 {
+        return fmt.Errorf("usage : cancel <session id>")
+    }
+    id, err := strconv.ParseUint(args[0], 10, 64)
+    if err != nil {
+        return fmt.Errorf("bad session id %q", args[0])
+    }
+    return cancel_session(id)
+}
+
+func admin_sessions(args []string, w io.Writer) (error) {
+    now := time.Now()
+    for _, info := range list_sessions() {
+        fmt.Fprintf(w, "id=%d type=%s key=%q peer=%s local=%s state=%s block=%d bytes=%d retransmits=%d age=%s\n",
+            info.Id, info.Type, info.Key, info.Peer, info.Local, info.State, info.Block, info.Bytes, info.Retransmits,
+            now.Sub(info.Start).Truncate(time.Millisecond))
+    }
+    return nil
+}
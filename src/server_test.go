@@ -0,0 +1,513 @@
+package main
+
+import(
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "errors"
+    "flag"
+    "fmt"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "ttftp/tftp"
+)
+
+// The server every integration test talks to, on an ephemeral port
+var test_server *Server
+
+func TestMain(m *testing.M) {
+    flag.Parse()
+    if testing.Verbose() == false {
+        *logLevel = "error"
+    }
+    chk_err(setup_logging())
+    chk_err(load_ban_allow(*banAllow))
+
+    srv, err := start_server("127.0.0.1:0")
+    chk_err(err)
+    test_server = srv
+    go srv.serve()
+
+    code := m.Run()
+    srv.close()
+    os.Exit(code)
+}
+
+func test_client(t *testing.T) (*tftp.Client) {
+    c, err := new_client(test_server.addr.String())
+    if err != nil {
+        t.Fatalf("new_client : %s", err.Error())
+    }
+    c.Timeout = 500 * time.Millisecond
+    return c
+}
+
+// Changes flags which sessions read, once every session has ended. Sessions
+// register first thing, holding the registry lock meanwhile orders the change
+// before the sessions to come
+func change_flags(t testing.TB, change func()) {
+    deadline := time.Now().Add(10 * time.Second)
+    for len(list_sessions()) > 0 {
+        if time.Now().After(deadline) == true {
+            t.Fatalf("%d sessions still active", len(list_sessions()))
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    registry.Lock()
+    defer registry.Unlock()
+    change()
+}
+
+// Writes content to key and reads it back, checking sizes and hashes
+func round_trip(t *testing.T, c *tftp.Client, key string, content []byte) {
+    ctx := context.Background()
+    n, err := c.Put(ctx, key, bytes.NewReader(content))
+    if err != nil {
+        t.Fatalf("Put %s : %s", key, err.Error())
+    }
+    if n != int64(len(content)) {
+        t.Fatalf("Put %s : sent %d bytes, want %d", key, n, len(content))
+    }
+    stored, ok := get(key)
+    if ok == false {
+        t.Fatalf("Put %s : not in the store", key)
+    }
+    if stored.hash != sha256.Sum256(content) {
+        t.Fatalf("Put %s : stored hash %x, want %x", key, stored.hash, sha256.Sum256(content))
+    }
+
+    h := sha256.New()
+    n, err = c.Get(ctx, key, h)
+    if err != nil {
+        t.Fatalf("Get %s : %s", key, err.Error())
+    }
+    if n != int64(len(content)) {
+        t.Fatalf("Get %s : received %d bytes, want %d", key, n, len(content))
+    }
+    if got := h.Sum(nil); bytes.Equal(got, stored.hash[:]) == false {
+        t.Fatalf("Get %s : hash %x, want %x", key, got, stored.hash)
+    }
+}
+
+func TestTransferSizes(t *testing.T) {
+    configs := []struct {
+        name string
+        blksize int
+        windowsize int
+    }{
+        { "rfc1350", tftp.BlockSize, 1 },
+        { "blksize1024", 1024, 1 },
+        { "blksize8", 8, 1 },
+        { "window8", tftp.BlockSize, 8 },
+        { "blksize1428-window16", 1428, 16 },
+    }
+    for _, cfg := range configs {
+        // sizes around the block size of the config and its multiples, the
+        // last block is short, possibly empty
+        b := cfg.blksize
+        sizes := []int{ 0, 1, b - 1, b, b + 1, 2 * b - 1, 2 * b, 2 * b + 1, 10 * b, 99845 }
+        for _, sz := range sizes {
+            t.Run(fmt.Sprintf("%s/%d", cfg.name, sz), func(t *testing.T) {
+                t.Parallel()
+                c := test_client(t)
+                c.Blksize = cfg.blksize
+                c.Windowsize = cfg.windowsize
+                round_trip(t, c, fmt.Sprintf("sizes/%s/%d", cfg.name, sz), random_content(int64(sz), sz))
+            })
+        }
+    }
+}
+
+// Past 65535 blocks the block number rolls over to 0
+func TestBlockRollover(t *testing.T) {
+    if testing.Short() {
+        t.Skip("long transfer")
+    }
+    tests := []struct {
+        name string
+        blksize int
+        windowsize int
+        sz int
+    }{
+        { "exact", 8, 32, 65536 * 8 },
+        { "past", 8, 32, 65536 * 8 + 100 },
+        { "twice", 16, 64, 2 * 65536 * 16 + 3 },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            c := test_client(t)
+            c.Blksize = tt.blksize
+            c.Windowsize = tt.windowsize
+            round_trip(t, c, "rollover/" + tt.name, random_content(3, tt.sz))
+        })
+    }
+}
+
+func TestErrorCodes(t *testing.T) {
+    ctx := context.Background()
+    tests := []struct {
+        name string
+        setup func()
+        op string
+        key string
+        code uint16
+        // held against the peer
+        offense bool
+    }{
+        { "missing file", nil, "get", "no/such/file", tftp.FileNotFound, false },
+        { "escaping filename", nil, "put", "../outside", tftp.AccessViolation, true },
+        { "control character", nil, "get", "bad\x01name", tftp.AccessViolation, true },
+        { "reserved index name", nil, "put", ".index", tftp.AccessViolation, true },
+        { "read-only", func() { set_server_mode("read-only") }, "put", "ro", tftp.AccessViolation, false },
+        { "write-only", func() { set_server_mode("write-only") }, "get", "wo", tftp.AccessViolation, false },
+        { "maintenance", func() { set_server_mode("maintenance") }, "get", "mt", tftp.NotDefined, false },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if tt.setup != nil {
+                tt.setup()
+                defer set_server_mode("normal")
+            }
+            c := test_client(t)
+            before := counter_snapshot()
+            var err error
+            if tt.op == "get" {
+                _, err = c.Get(ctx, tt.key, new(bytes.Buffer))
+            } else {
+                _, err = c.Put(ctx, tt.key, bytes.NewReader([]byte("data")))
+            }
+            var se *tftp.ServerError
+            if errors.As(err, &se) == false {
+                t.Fatalf("got %v, want a server error", err)
+            }
+            if se.Code != tt.code {
+                t.Errorf("got ERROR code %d ( %s ), want %d", se.Code, se.Msg, tt.code)
+            }
+            // the session of a missing file ends once the ERROR is sent
+            time.Sleep(20 * time.Millisecond)
+            after := counter_snapshot()
+            offenses := after["offense_access_violation"] - before["offense_access_violation"] +
+                after["offense_failed_session"] - before["offense_failed_session"]
+            if (offenses > 0) != tt.offense {
+                t.Errorf("got %d offenses, want offense %v", offenses, tt.offense)
+            }
+        })
+    }
+}
+
+func TestCancel(t *testing.T) {
+    c := test_client(t)
+    c.Blksize = 8
+    if _, err := c.Put(context.Background(), "cancel/src", bytes.NewReader(random_content(4, 1024 * 1024))); err != nil {
+        t.Fatalf("Put : %s", err.Error())
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+    defer cancel()
+    n, err := c.Get(ctx, "cancel/src", new(bytes.Buffer))
+    if errors.Is(err, context.DeadlineExceeded) == false {
+        t.Fatalf("got %v after %d bytes, want the context's error", err, n)
+    }
+}
+
+func TestResumeDownload(t *testing.T) {
+    c := test_client(t)
+    content := random_content(5, 5000)
+    if _, err := c.Put(context.Background(), "resume/file", bytes.NewReader(content)); err != nil {
+        t.Fatalf("Put : %s", err.Error())
+    }
+    tests := []struct {
+        name string
+        part []byte
+        err error
+    }{
+        { "empty part", nil, nil },
+        { "half", content[0:2500], nil },
+        { "complete", content, nil },
+        { "corrupt part", append([]byte("X"), content[1:1000]...), tftp.ErrHashMismatch },
+        { "part too long", append(append([]byte{}, content...), 'Z'), nil },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            f, err := os.Create(filepath.Join(t.TempDir(), "part"))
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer f.Close()
+            f.Write(tt.part)
+            n, err := c.Resume(context.Background(), "resume/file", f)
+            if errors.Is(err, tt.err) == false || (tt.err == nil && err != nil) {
+                t.Fatalf("got %v, want %v", err, tt.err)
+            }
+            if tt.err != nil {
+                return
+            }
+            got, _ := os.ReadFile(f.Name())
+            if n != int64(len(content)) || bytes.Equal(got, content) == false {
+                t.Errorf("resumed file of %d bytes ( n=%d ) differs", len(got), n)
+            }
+        })
+    }
+}
+
+// What is sent to a peer that answers is refunded, a small budget is enough
+// for any number of sessions of well-behaved clients
+func TestResponseBudgetRefund(t *testing.T) {
+    budget := *responseBudget
+    change_flags(t, func() {
+        *responseBudget = 256
+    })
+    budgets.Lock()
+    budgets.b = make(map[string]*ResponseBudget)
+    budgets.Unlock()
+    defer change_flags(t, func() {
+        *responseBudget = budget
+    })
+
+    c := test_client(t)
+    content := random_content(7, 2 * tftp.BlockSize + 1)
+    for i := 0; i < 20; i++ {
+        round_trip(t, c, "budget/file", content)
+    }
+}
+
+// A peer negotiating a long timeout does not keep a completed session
+// dallying for that long
+func TestDallyCapped(t *testing.T) {
+    c := test_client(t)
+    c.Timeout = 255 * time.Second
+    c.SendTimeout = true
+    if _, err := c.Put(context.Background(), "dally/file", bytes.NewReader(random_content(8, 100))); err != nil {
+        t.Fatalf("Put : %s", err.Error())
+    }
+    deadline := time.Now().Add(*rexmtTimeout + 2 * time.Second)
+    for {
+        active := false
+        for _, info := range list_sessions() {
+            active = active || info.Key == "dally/file"
+        }
+        if active == false {
+            return
+        }
+        if time.Now().After(deadline) == true {
+            t.Fatalf("session still dallying after %s", *rexmtTimeout + 2 * time.Second)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+// Content other than the expected one is never stored, even when it only
+// shows once read : the upload is aborted before its last block
+func TestBatchPutMismatch(t *testing.T) {
+    c := test_client(t)
+    content := random_content(9, 3 * tftp.BlockSize)
+    for _, sz := range []int{ len(content), len(content) - 100 } {
+        key := fmt.Sprintf("batch/mismatch/%d", sz)
+        e := &BatchEntry{ remote : key, sha256 : fmt.Sprintf("%x", sha256.Sum256([]byte("other"))) }
+        _, err := c.Put(context.Background(), key, &checked_reader{ bytes.NewReader(content[0:sz]), sha256.New(), e })
+        if errors.Is(err, tftp.ErrHashMismatch) == false {
+            t.Errorf("Put of %d bytes : got %v, want %v", sz, err, tftp.ErrHashMismatch)
+        }
+        if _, ok := get(key); ok == true {
+            t.Errorf("Put of %d bytes : stored despite the mismatch", sz)
+        }
+        if batch_retryable(err) == true {
+            t.Errorf("%v is retried", err)
+        }
+    }
+}
+
+// The HTTP API refuses reads as TFTP would : by the server mode and the read
+// rules of the access list, which also filter listings
+func TestHTTPReadAccess(t *testing.T) {
+    for _, key := range []string{ "http/open", "http/secret" } {
+        fw := new_file_writer()
+        fw.write([]byte(strings.TrimPrefix(key, "http/")))
+        put(key, fw.close())
+    }
+    rules, err := parse_acl(strings.NewReader("deny read 192.0.2.0/24 http/secret\n"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    acl.Lock()
+    acl.rules = rules
+    acl.Unlock()
+    defer func() {
+        acl.Lock()
+        acl.rules = nil
+        acl.Unlock()
+    }()
+
+    // httptest requests come from 192.0.2.1
+    get := func(handler http.HandlerFunc, target string) (*httptest.ResponseRecorder) {
+        w := httptest.NewRecorder()
+        handler(w, httptest.NewRequest("GET", target, nil))
+        return w
+    }
+    if w := get(http_file, "/files/http/open"); w.Code != http.StatusOK || w.Body.String() != "open" {
+        t.Errorf("GET http/open : %d %q", w.Code, w.Body.String())
+    }
+    for _, target := range []string{ "/files/http/secret", "/meta/http/secret" } {
+        handler := http_file
+        if strings.HasPrefix(target, "/meta/") {
+            handler = http_meta
+        }
+        if w := get(handler, target); w.Code != http.StatusForbidden {
+            t.Errorf("GET %s : %d, want %d", target, w.Code, http.StatusForbidden)
+        }
+    }
+    if w := get(http_files, "/files?prefix=http/"); strings.Contains(w.Body.String(), "http/secret") || strings.Contains(w.Body.String(), "http/open") == false {
+        t.Errorf("listing : %s", w.Body.String())
+    }
+
+    set_server_mode("write-only")
+    defer set_server_mode("normal")
+    for _, target := range []string{ "/files/http/open", "/files?prefix=http/" } {
+        handler := http_file
+        if strings.HasPrefix(target, "/files?") {
+            handler = http_files
+        }
+        if w := get(handler, target); w.Code != http.StatusForbidden {
+            t.Errorf("GET %s in write-only mode : %d, want %d", target, w.Code, http.StatusForbidden)
+        }
+    }
+}
+
+// A peer using the token of another one's kept upload neither takes it nor
+// replaces it when its own upload fails
+func TestPartialTokenShared(t *testing.T) {
+    grace := *uploadGrace
+    change_flags(t, func() {
+        *uploadGrace = time.Minute
+    })
+    defer change_flags(t, func() {
+        *uploadGrace = grace
+    })
+
+    first, second := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+    kept := func(content string) (*FileWriter) {
+        fw := new_file_writer()
+        fw.write([]byte(content))
+        return fw
+    }
+    a, b := kept("first"), kept("second")
+    retain_partial("shared", "partial/key", first, a)
+    if take_partial("shared", "partial/key", second) != nil {
+        t.Fatalf("second peer took the upload of the first")
+    }
+    retain_partial("shared", "partial/key", second, b)
+    if got := take_partial("shared", "partial/key", first); got != a {
+        t.Errorf("first peer got %v back, want its own upload", got)
+    }
+    if got := take_partial("shared", "partial/key", second); got != b {
+        t.Errorf("second peer got %v back, want its own upload", got)
+    }
+    if n, _ := partial_stats(); n != 0 {
+        t.Errorf("%d uploads still kept", n)
+    }
+}
+
+// An ACK of the block before a window means its first block was lost, the
+// session sends the window again without waiting for a timeout
+func TestWindowFirstBlockLost(t *testing.T) {
+    content := random_content(10, 100)
+    c := test_client(t)
+    if _, err := c.Put(context.Background(), "window/lost", bytes.NewReader(content)); err != nil {
+        t.Fatalf("Put : %s", err.Error())
+    }
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{ IP : net.IPv4(127, 0, 0, 1) })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    req := &tftp.Message{ Opcode : 2, Key : "window/lost", Options : map[string]string{ "blksize" : "8", "windowsize" : "4" } }
+    if _, err := conn.WriteTo(tftp.Encode(req).Bytes(), test_server.addr); err != nil {
+        t.Fatal(err)
+    }
+    buffer := make([]byte, 1024)
+    read := func(timeout time.Duration) (*tftp.Message, *net.UDPAddr) {
+        conn.SetReadDeadline(time.Now().Add(timeout))
+        n, src, err := conn.ReadFromUDP(buffer)
+        if err != nil {
+            t.Fatalf("reading : %s", err.Error())
+        }
+        m, err := tftp.Decode(bytes.NewBuffer(buffer[0:n]))
+        if err != nil {
+            t.Fatal(err)
+        }
+        return m, src
+    }
+    oack, tid := read(time.Second)
+    if oack.Opcode != 6 {
+        t.Fatalf("got %s, want an OACK", oack.String())
+    }
+    conn.WriteTo(tftp.Encode(tftp.NewAck(0)).Bytes(), tid)
+    for i := 1; i <= 4; i++ {
+        if m, _ := read(time.Second); m.Opcode != 3 || m.Block != uint16(i) {
+            t.Fatalf("got %s, want DATA block %d", m.String(), i)
+        }
+    }
+    conn.WriteTo(tftp.Encode(tftp.NewAck(0)).Bytes(), tid)
+    if m, _ := read(*rexmtTimeout / 2); m.Opcode != 3 || m.Block != 1 {
+        t.Fatalf("got %s, want DATA block 1 again", m.String())
+    }
+    conn.WriteTo(tftp.Encode(tftp.NewError(tftp.NotDefined, "done")).Bytes(), tid)
+}
+
+// batch get of a directory downloads the keys under the prefix from the
+// server's listing, checked against the hashes it gives
+func TestBatchGetTree(t *testing.T) {
+    c := test_client(t)
+    contents := map[string][]byte{
+        "tree/a" : random_content(11, 10),
+        "tree/sub/b" : random_content(12, tftp.BlockSize),
+        "tree/sub/deeper/c" : random_content(13, 3 * tftp.BlockSize + 7),
+    }
+    for key, content := range contents {
+        round_trip(t, c, key, content)
+    }
+    round_trip(t, c, "treeless", random_content(14, 5))
+
+    for _, format := range []string{ "text", "json" } {
+        func() {
+            old := *indexFormat
+            *indexFormat = format
+            defer func() { *indexFormat = old }()
+
+            dir := t.TempDir()
+            entries, err := list_batch_remote(context.Background(), c, "tree", ".index", dir)
+            if err != nil {
+                t.Fatalf("%s listing : %s", format, err.Error())
+            }
+            if len(entries) != len(contents) {
+                t.Fatalf("%s listing : got %d entries, want %d", format, len(entries), len(contents))
+            }
+            for _, res := range run_batch_transfers(context.Background(), c, "get", entries, 2, 1) {
+                if res.err != nil {
+                    t.Errorf("get %s : %s", res.entry.remote, res.err.Error())
+                }
+            }
+            for key, content := range contents {
+                got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(key, "tree/"))))
+                if err != nil || bytes.Equal(got, content) == false {
+                    t.Errorf("%s : %s downloaded wrong ( %v )", format, key, err)
+                }
+            }
+        }()
+    }
+}
+
+func TestParseListingOutsidePrefix(t *testing.T) {
+    infos, err := parse_listing([]byte("1\t2024-01-01T00:00:00Z\tab\tx/../../etc\n"))
+    if err != nil || len(infos) != 1 {
+        t.Fatalf("got %v, %v", infos, err)
+    }
+    if filepath.IsLocal(filepath.FromSlash(infos[0].Key)) == true {
+        t.Errorf("%q taken as local", infos[0].Key)
+    }
+}
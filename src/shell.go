@@ -0,0 +1,487 @@
+package main
+
+import(
+    "bufio"
+    "context"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "os/signal"
+    "path"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "ttftp/tftp"
+)
+
+// ---------------------------------
+// Interactive Shell
+// ---------------------------------
+//   ttftp [flags] shell [client flags] [-history file] [host[:port]]
+//
+// An interactive client in the manner of BSD tftp, on top of the same Client
+// as the get / put commands. Lines are read from stdin, the prompt and line
+// editing ( see LineEditor ) are only there on a terminal so command files can
+// be piped in. History :
+// - up and down recall the lines entered
+// - history : lists the lines entered, numbered
+// - !! : repeats the last line, !n line n and !prefix the last line starting
+//   with prefix
+// - lines are appended to -history and loaded again on the next start
+// Interrupting a transfer cancels it and returns to the prompt, at the prompt
+// it discards the line. The shell exits with the code of the last command
+// which failed, 0 if none did
+type Shell struct {
+    client *tftp.Client
+    server string
+    max_timeout time.Duration
+    verbose bool
+    trace bool
+    history []string
+    history_file *os.File
+    out io.Writer
+    status int
+}
+
+type ShellCommand struct {
+    usage string
+    help string
+    run func(sh *Shell, args []string) int
+}
+
+var shell_commands = map[string]*ShellCommand{}
+
+// Lines of the history file loaded on start
+const shell_history_max int = 500
+
+func init() {
+    shell_commands["connect"] = &ShellCommand{ "connect host [port]", "set the server to transfer with", shell_connect }
+    shell_commands["mode"] = &ShellCommand{ "mode [ascii|netascii|binary|octet]", "set or show the transfer mode", shell_mode }
+    shell_commands["binary"] = &ShellCommand{ "binary", "set the transfer mode to octet", shell_binary }
+    shell_commands["ascii"] = &ShellCommand{ "ascii", "set the transfer mode to netascii", shell_ascii }
+    shell_commands["get"] = &ShellCommand{ "get remote [local]", "receive a file, local - is stdout", shell_get }
+    shell_commands["put"] = &ShellCommand{ "put local [remote]", "send a file", shell_put }
+    shell_commands["blksize"] = &ShellCommand{ "blksize [n]", "set or show the block size to negotiate", shell_blksize }
+    shell_commands["windowsize"] = &ShellCommand{ "windowsize [n]", "set or show the blocks per ACK to negotiate", shell_windowsize }
+    shell_commands["timeout"] = &ShellCommand{ "timeout [seconds]", "set or show the total transmission timeout", shell_timeout }
+    shell_commands["rexmt"] = &ShellCommand{ "rexmt [seconds]", "set or show the per-packet retransmission timeout", shell_rexmt }
+    shell_commands["verbose"] = &ShellCommand{ "verbose", "toggle verbose mode", shell_verbose }
+    shell_commands["trace"] = &ShellCommand{ "trace", "toggle packet tracing", shell_trace }
+    shell_commands["status"] = &ShellCommand{ "status", "show the current settings", shell_status }
+    shell_commands["history"] = &ShellCommand{ "history", "list the lines entered", shell_history }
+    shell_commands["help"] = &ShellCommand{ "help | ?", "list the commands", shell_help }
+    shell_commands["?"] = shell_commands["help"]
+    shell_commands["quit"] = &ShellCommand{ "quit | exit", "leave the shell", nil }
+    shell_commands["exit"] = shell_commands["quit"]
+}
+
+func run_shell(args []string) (int) {
+    c := new(tftp.Client)
+    fs, apply := client_flags("shell", c)
+    history := fs.String("history", default_history_file(), "file to keep the shell history in, empty disables")
+    if err := fs.Parse(args); err != nil {
+        return exit_usage
+    }
+    if err := apply(); err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        return exit_usage
+    }
+    if fs.NArg() > 1 {
+        fs.Usage()
+        return exit_usage
+    }
+
+    sh := new(Shell)
+    sh.client = c
+    sh.out = os.Stdout
+    sh.max_timeout = c.Timeout * time.Duration(c.Retries + 1)
+    if fs.NArg() == 1 {
+        if sh.run_line("connect " + fs.Arg(0)) != exit_ok {
+            return exit_usage
+        }
+    }
+    if *history != "" {
+        sh.load_history(*history)
+    }
+    defer func() {
+        if sh.history_file != nil {
+            sh.history_file.Close()
+        }
+    }()
+
+    // a terminal gets the prompt and line editing, anything else is read
+    // line by line
+    var read_line func() (string, error)
+    interactive := false
+    if fi, err := os.Stdin.Stat(); err == nil && fi.Mode() & os.ModeCharDevice != 0 {
+        interactive = true
+        ed := new_line_editor(os.Stdin, sh.out)
+        defer ed.catch_interrupts()()
+        read_line = func() (string, error) {
+            return ed.read_line("tftp> ", sh.history)
+        }
+    } else {
+        scanner := bufio.NewScanner(os.Stdin)
+        read_line = func() (string, error) {
+            if scanner.Scan() == false {
+                if scanner.Err() == nil {
+                    return "", io.EOF
+                }
+                return "", scanner.Err()
+            }
+            return scanner.Text(), nil
+        }
+    }
+    var err error
+    for {
+        var line string
+        line, err = read_line()
+        if err != nil {
+            break
+        }
+        line = strings.TrimSpace(line)
+        if line == "" {
+            continue
+        }
+        line, ok := sh.expand_history(line)
+        if ok == false {
+            sh.status = exit_usage
+            continue
+        }
+        sh.add_history(line)
+        if fields := strings.Fields(line); shell_commands[fields[0]] == shell_commands["quit"] {
+            break
+        }
+        if code := sh.run_line(line); code != exit_ok {
+            sh.status = code
+        }
+    }
+    if interactive == true && err != nil {
+        fmt.Fprintf(sh.out, "\n")
+    }
+    if err != nil && err != io.EOF {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        return exit_local
+    }
+    return sh.status
+}
+
+func (sh *Shell) run_line(line string) (int) {
+    fields := strings.Fields(line)
+    cmd, ok := shell_commands[fields[0]]
+    if ok == false || cmd.run == nil {
+        fmt.Fprintf(os.Stderr, "?Invalid command %q, try help\n", fields[0])
+        return exit_usage
+    }
+    return cmd.run(sh, fields[1:])
+}
+
+func shell_usage(cmd string) (int) {
+    fmt.Fprintf(os.Stderr, "usage : %s\n", shell_commands[cmd].usage)
+    return exit_usage
+}
+
+func shell_error(err error) (int) {
+    fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+    return exit_usage
+}
+
+// ---------------------------------
+// Shell History
+// ---------------------------------
+func default_history_file() (string) {
+    home, err := os.UserHomeDir()
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(home, ".ttftp_history")
+}
+
+// Loads the tail of the history file and opens it for appending, the shell
+// works without history when it cannot be opened
+func (sh *Shell) load_history(filename string) {
+    if f, err := os.Open(filename); err == nil {
+        scanner := bufio.NewScanner(f)
+        for scanner.Scan() {
+            if line := strings.TrimSpace(scanner.Text()); line != "" {
+                sh.history = append(sh.history, line)
+            }
+        }
+        f.Close()
+        if len(sh.history) > shell_history_max {
+            sh.history = sh.history[len(sh.history) - shell_history_max:]
+        }
+    }
+    f, err := os.OpenFile(filename, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+    if err != nil {
+        client_log.warnf("Unable to open the history file %s : %s", filename, err.Error())
+        return
+    }
+    sh.history_file = f
+}
+
+func (sh *Shell) add_history(line string) {
+    sh.history = append(sh.history, line)
+    if sh.history_file != nil {
+        fmt.Fprintf(sh.history_file, "%s\n", line)
+    }
+}
+
+// Replaces a leading !!, !n or !prefix with the line of the history it
+// refers to, which is echoed
+func (sh *Shell) expand_history(line string) (string, bool) {
+    if strings.HasPrefix(line, "!") == false {
+        return line, true
+    }
+    fields := strings.SplitN(line, " ", 2)
+    ref := fields[0][1:]
+    found := ""
+    if ref == "!" {
+        if len(sh.history) > 0 {
+            found = sh.history[len(sh.history) - 1]
+        }
+    } else if n, err := strconv.Atoi(ref); err == nil {
+        if n >= 1 && n <= len(sh.history) {
+            found = sh.history[n - 1]
+        }
+    } else if ref != "" {
+        for i := len(sh.history) - 1; i >= 0; i-- {
+            if strings.HasPrefix(sh.history[i], ref) == true {
+                found = sh.history[i]
+                break
+            }
+        }
+    }
+    if found == "" {
+        fmt.Fprintf(os.Stderr, "%s: event not found\n", fields[0])
+        return "", false
+    }
+    if len(fields) == 2 {
+        found = found + " " + fields[1]
+    }
+    fmt.Fprintf(sh.out, "%s\n", found)
+    return found, true
+}
+
+func shell_history(sh *Shell, args []string) (int) {
+    for i, line := range sh.history {
+        fmt.Fprintf(sh.out, "%5d  %s\n", i + 1, line)
+    }
+    return exit_ok
+}
+
+// ---------------------------------
+// Shell Commands
+// ---------------------------------
+func shell_help(sh *Shell, args []string) (int) {
+    names := make([]string, 0, len(shell_commands))
+    for name := range shell_commands {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    listed := make(map[*ShellCommand]bool)
+    for _, name := range names {
+        cmd := shell_commands[name]
+        if listed[cmd] == true {
+            continue
+        }
+        listed[cmd] = true
+        fmt.Fprintf(sh.out, "%-36s %s\n", cmd.usage, cmd.help)
+    }
+    fmt.Fprintf(sh.out, "%-36s %s\n", "!! | !n | !prefix", "run a line of the history again")
+    return exit_ok
+}
+
+func shell_connect(sh *Shell, args []string) (int) {
+    if len(args) < 1 || len(args) > 2 {
+        return shell_usage("connect")
+    }
+    server := args[0]
+    if len(args) == 2 {
+        server = net.JoinHostPort(args[0], args[1])
+    }
+    c, err := configure_client(sh.client, server)
+    if err != nil {
+        return shell_error(err)
+    }
+    sh.client = c
+    sh.server = server
+    if sh.verbose == true {
+        fmt.Fprintf(sh.out, "Connected to %s\n", c.Addr.String())
+    }
+    return exit_ok
+}
+
+func shell_mode(sh *Shell, args []string) (int) {
+    if len(args) == 0 {
+        fmt.Fprintf(sh.out, "Using %s mode to transfer files.\n", sh.client.Mode)
+        return exit_ok
+    }
+    if len(args) > 1 {
+        return shell_usage("mode")
+    }
+    if args[0] == "ascii" || args[0] == "netascii" {
+        sh.client.Mode = "netascii"
+    } else if args[0] == "binary" || args[0] == "octet" {
+        sh.client.Mode = "octet"
+    } else {
+        fmt.Fprintf(os.Stderr, "%s: unknown mode\n", args[0])
+        return shell_usage("mode")
+    }
+    return exit_ok
+}
+
+func shell_binary(sh *Shell, args []string) (int) {
+    return shell_mode(sh, []string{ "octet" })
+}
+
+func shell_ascii(sh *Shell, args []string) (int) {
+    return shell_mode(sh, []string{ "netascii" })
+}
+
+// Shows or sets one of the numeric settings, within min and max
+func shell_setting(sh *Shell, cmd string, args []string, value *int, min int, max int) (int) {
+    if len(args) == 0 {
+        fmt.Fprintf(sh.out, "%s is %d\n", cmd, *value)
+        return exit_ok
+    }
+    if len(args) > 1 {
+        return shell_usage(cmd)
+    }
+    n, err := strconv.Atoi(args[0])
+    if err != nil || n < min || n > max {
+        fmt.Fprintf(os.Stderr, "%s must be between %d and %d\n", cmd, min, max)
+        return exit_usage
+    }
+    *value = n
+    return exit_ok
+}
+
+func shell_blksize(sh *Shell, args []string) (int) {
+    return shell_setting(sh, "blksize", args, &sh.client.Blksize, 8, tftp.MaxBlksize)
+}
+
+func shell_windowsize(sh *Shell, args []string) (int) {
+    return shell_setting(sh, "windowsize", args, &sh.client.Windowsize, 1, 65535)
+}
+
+// The client retransmits every rexmt until timeout has passed without an
+// answer
+func (sh *Shell) set_retries() {
+    sh.client.Retries = int(sh.max_timeout / sh.client.Timeout) - 1
+    if sh.client.Retries < 0 {
+        sh.client.Retries = 0
+    }
+}
+
+func shell_timeout(sh *Shell, args []string) (int) {
+    secs := int(sh.max_timeout / time.Second)
+    if code := shell_setting(sh, "timeout", args, &secs, 1, 3600); code != exit_ok {
+        return code
+    }
+    sh.max_timeout = time.Duration(secs) * time.Second
+    sh.set_retries()
+    return exit_ok
+}
+
+func shell_rexmt(sh *Shell, args []string) (int) {
+    secs := int(sh.client.Timeout / time.Second)
+    if code := shell_setting(sh, "rexmt", args, &secs, 1, 255); code != exit_ok {
+        return code
+    }
+    sh.client.Timeout = time.Duration(secs) * time.Second
+    sh.set_retries()
+    return exit_ok
+}
+
+func on_off(b bool) (string) {
+    if b == true {
+        return "on"
+    }
+    return "off"
+}
+
+func shell_verbose(sh *Shell, args []string) (int) {
+    sh.verbose = !sh.verbose
+    fmt.Fprintf(sh.out, "Verbose mode %s.\n", on_off(sh.verbose))
+    return exit_ok
+}
+
+func shell_trace(sh *Shell, args []string) (int) {
+    sh.trace = !sh.trace
+    sh.client.Trace = nil
+    if sh.trace == true {
+        sh.client.Trace = sh.out
+    }
+    fmt.Fprintf(sh.out, "Packet tracing %s.\n", on_off(sh.trace))
+    return exit_ok
+}
+
+func shell_status(sh *Shell, args []string) (int) {
+    c := sh.client
+    if c.Addr != nil {
+        fmt.Fprintf(sh.out, "Connected to %s.\n", c.Addr.String())
+    } else {
+        fmt.Fprintf(sh.out, "Not connected.\n")
+    }
+    fmt.Fprintf(sh.out, "Mode: %s Verbose: %s Tracing: %s\n", c.Mode, on_off(sh.verbose), on_off(sh.trace))
+    fmt.Fprintf(sh.out, "Rexmt-interval: %d seconds, Max-timeout: %d seconds\n", int(c.Timeout / time.Second), int(sh.max_timeout / time.Second))
+    fmt.Fprintf(sh.out, "Blksize: %d Windowsize: %d\n", c.Blksize, c.Windowsize)
+    return exit_ok
+}
+
+// Runs a transfer which can be interrupted without leaving the shell
+func (sh *Shell) transfer(what string, desc string, xfer func(ctx context.Context, c *tftp.Client) (int64, error)) (int) {
+    if sh.client.Addr == nil {
+        fmt.Fprintf(os.Stderr, "No target machine specified, connect first.\n")
+        return exit_usage
+    }
+    if sh.verbose == true {
+        fmt.Fprintf(sh.out, "%s [%s]\n", desc, sh.client.Mode)
+    }
+    start := time.Now()
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+    n, err := xfer(ctx, sh.client)
+    if err != nil {
+        return transfer_exit_code(err)
+    }
+    if sh.verbose == true {
+        elapsed := time.Since(start)
+        fmt.Fprintf(sh.out, "%s %d bytes in %.1f seconds [%.0f bit/s]\n", what, n, elapsed.Seconds(), float64(n * 8) / elapsed.Seconds())
+    }
+    return exit_ok
+}
+
+func shell_get(sh *Shell, args []string) (int) {
+    if len(args) < 1 || len(args) > 2 {
+        return shell_usage("get")
+    }
+    remote := args[0]
+    local := path.Base(remote)
+    if len(args) == 2 {
+        local = args[1]
+    }
+    desc := fmt.Sprintf("getting from %s:%s to %s", sh.server, remote, local)
+    return sh.transfer("Received", desc, func(ctx context.Context, c *tftp.Client) (int64, error) {
+        return get_file(ctx, c, remote, local)
+    })
+}
+
+func shell_put(sh *Shell, args []string) (int) {
+    if len(args) < 1 || len(args) > 2 {
+        return shell_usage("put")
+    }
+    local := args[0]
+    remote := path.Base(local)
+    if len(args) == 2 {
+        remote = args[1]
+    }
+    desc := fmt.Sprintf("putting %s to %s:%s", local, sh.server, remote)
+    return sh.transfer("Sent", desc, func(ctx context.Context, c *tftp.Client) (int64, error) {
+        return put_file(ctx, c, local, remote)
+    })
+}
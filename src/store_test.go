@@ -0,0 +1,161 @@
+package main
+
+import(
+    "bytes"
+    "crypto/sha256"
+    "math/rand"
+    "testing"
+    "ttftp/tftp"
+)
+
+// Empties the store and sets its mode, the store is shared by every test
+func reset_store(t *testing.T, dedup bool) {
+    filestore.Lock()
+    filestore.t = make(map[string]*File)
+    filestore.blobs = make(map[[sha256.Size]byte]*Blob)
+    filestore.dedup = dedup
+    filestore.Unlock()
+    t.Cleanup(func() {
+        filestore.Lock()
+        filestore.t = make(map[string]*File)
+        filestore.blobs = make(map[[sha256.Size]byte]*Blob)
+        filestore.dedup = false
+        filestore.Unlock()
+    })
+}
+
+func random_content(seed int64, sz int) ([]byte) {
+    b := make([]byte, sz)
+    rand.New(rand.NewSource(seed)).Read(b)
+    return b
+}
+
+func TestFileWriter(t *testing.T) {
+    sizes := []int{ 0, 1, tftp.BlockSize - 1, tftp.BlockSize, tftp.BlockSize + 1, segment_sz - 1, segment_sz, segment_sz + 1, 3 * segment_sz + 7 }
+    chunks := []int{ 1, 511, tftp.BlockSize, 1428, segment_sz, 2 * segment_sz }
+    for _, sz := range sizes {
+        for _, chunk := range chunks {
+            content := random_content(int64(sz), sz)
+            w := new_file_writer()
+            for off := 0; off < sz; off += chunk {
+                end := off + chunk
+                if end > sz {
+                    end = sz
+                }
+                w.write(content[off:end])
+            }
+            f := w.close()
+            if f.sz != sz {
+                t.Fatalf("size %d in chunks of %d : file has %d bytes", sz, chunk, f.sz)
+            }
+            if f.hash != sha256.Sum256(content) {
+                t.Errorf("size %d in chunks of %d : hash mismatch", sz, chunk)
+            }
+            for _, seg := range f.segs[0:max(len(f.segs) - 1, 0)] {
+                if len(seg) != segment_sz {
+                    t.Errorf("size %d in chunks of %d : inner segment of %d bytes", sz, chunk, len(seg))
+                }
+            }
+
+            // read back through read_at with buffers straddling segments
+            got := make([]byte, 0, sz)
+            buf := make([]byte, chunk)
+            for off := 0; ; {
+                n := f.read_at(buf, off)
+                got = append(got, buf[0:n]...)
+                off += n
+                if n < len(buf) {
+                    break
+                }
+            }
+            if bytes.Equal(got, content) == false {
+                t.Errorf("size %d in chunks of %d : read_at returned other bytes", sz, chunk)
+            }
+        }
+    }
+}
+
+func TestReadAtPastEnd(t *testing.T) {
+    f := create_file([]byte("hello"))
+    tests := []struct {
+        off int
+        buf int
+        want string
+    }{
+        { 0, 5, "hello" },
+        { 0, 10, "hello" },
+        { 3, 10, "lo" },
+        { 5, 10, "" },
+        { 9, 10, "" },
+    }
+    for _, tt := range tests {
+        buf := make([]byte, tt.buf)
+        n := f.read_at(buf, tt.off)
+        if string(buf[0:n]) != tt.want {
+            t.Errorf("read_at(%d bytes, %d) = %q, want %q", tt.buf, tt.off, buf[0:n], tt.want)
+        }
+    }
+}
+
+func TestStore(t *testing.T) {
+    for _, dedup := range []bool{ false, true } {
+        name := "copy"
+        if dedup == true {
+            name = "dedup"
+        }
+        t.Run(name, func(t *testing.T) {
+            reset_store(t, dedup)
+            a := random_content(1, segment_sz + 3)
+            b := random_content(2, 100)
+
+            put("dir/a", create_file(a))
+            put("dir/a2", create_file(a))
+            put("b", create_file(b))
+            if _, ok := get("missing"); ok == true {
+                t.Errorf("get of a missing key succeeded")
+            }
+            for key, want := range map[string][]byte{ "dir/a" : a, "dir/a2" : a, "b" : b } {
+                f, ok := get(key)
+                if ok == false {
+                    t.Fatalf("get %s : missing", key)
+                }
+                got := make([]byte, f.sz)
+                f.read_at(got, 0)
+                if bytes.Equal(got, want) == false || f.hash != sha256.Sum256(want) {
+                    t.Errorf("get %s : wrong content", key)
+                }
+            }
+
+            keys, logical, physical := store_stats()
+            want_physical := 2 * len(a) + len(b)
+            if dedup == true {
+                want_physical = len(a) + len(b)
+            }
+            if keys != 3 || logical != 2 * len(a) + len(b) || physical != want_physical {
+                t.Errorf("store_stats = %d, %d, %d, want 3, %d, %d", keys, logical, physical, 2 * len(a) + len(b), want_physical)
+            }
+
+            infos := list("dir/")
+            if len(infos) != 2 || infos[0].Key != "dir/a" || infos[1].Key != "dir/a2" {
+                t.Errorf("list dir/ = %+v", infos)
+            }
+
+            // overwriting and deleting drop the blobs nobody refers to
+            put("dir/a", create_file(b))
+            if del("dir/a2") == false || del("dir/a2") == true {
+                t.Errorf("del dir/a2 : wrong existence")
+            }
+            _, _, physical = store_stats()
+            want_physical = 2 * len(b)
+            if dedup == true {
+                want_physical = len(b)
+            }
+            if physical != want_physical {
+                t.Errorf("physical bytes %d after overwrite and delete, want %d", physical, want_physical)
+            }
+            if dedup == true && len(filestore.blobs) != 1 {
+                t.Errorf("%d blobs left, want 1", len(filestore.blobs))
+            }
+        })
+    }
+}
@@ -3,26 +3,28 @@ package main
 // TODO 
 // - Fix for sending last ack upon storing file
 // - Endianess 
-// - Validate requesting endpoint so that no x-talk between sessions or hijacking
 // - Robust error handling
 // - ERR packets for some instances
 
 import(
     "bytes"
+    "context"
     "crypto/rand"
     "crypto/sha1"
-    "encoding/base64"
-    "encoding/binary"
+    "crypto/sha256"
+    "encoding/json"
+    "errors"
     "flag"
     "fmt"
-    "io"
-    "log"
-    "math/big"
+    "hash"
     "net"
     "os"
+    "sort"
     "strconv"
     "strings"
     "sync"
+    "time"
+    "ttftp/tftp"
 )
 
 // ---------------------------------
@@ -30,383 +32,675 @@ import(
 // ---------------------------------
 const(
     control_port string = "localhost:9991"
-    chunk_sz int = 512
-    tftp_data_header_bytes int = 4
+    default_admin_addr string = "localhost:9992"
 )
 
 // ---------------------------------
-// TFTP Protocol Encoding/Decoding
+// ERROR Packets
 // ---------------------------------
-type Message struct {
-    opcode uint16
-    key string
-    payload [chunk_sz]byte
-    block uint16
-    errcode uint16
-    errmsg string
-    sz int
+// Sends an ERROR packet, errors are best effort in TFTP so failures to send
+// them are only traced
+func send_error(conn net.PacketConn, addr *net.UDPAddr, key string, code uint16, msg string, log *Logger) {
+    er := tftp.NewError(code, msg)
+    metric_errors.inc(strconv.Itoa(int(code)), "sent")
+    packet := tftp.Encode(er).Bytes()
+    capture_packet(conn.LocalAddr().(*net.UDPAddr), addr, false, key, packet)
+    n, err := conn.WriteTo(packet, addr)
+    if err != nil {
+        log.warnf("<send> : failed to send %s to %s : %s", er.String(), addr.String(), err.Error())
+        return
+    }
+    log.debugf("<send> : message-out=%s, bytes=%d, dst=%s", er.String(), n, addr.String())
 }
 
-func (m Message) String() (string) {
-    buf := new(bytes.Buffer)
-
-    buf.WriteString("[ ")
-    if m.opcode == 1 {
-        buf.WriteString("<")
-        buf.WriteString("WRQ")
-        buf.WriteString(">")
-        buf.WriteString(" Key=")
-        buf.WriteString(m.key)
-    } else if m.opcode == 2 {
-        buf.WriteString("<")
-        buf.WriteString("RRQ")
-        buf.WriteString(">")
-        buf.WriteString(" ")
-        buf.WriteString(m.key)
-    } else if m.opcode == 3 {
-        buf.WriteString("<")
-        buf.WriteString("DATA")
-        buf.WriteString(">")
-        buf.WriteString(" Block=")
-        buf.WriteString(strconv.Itoa(int(m.block)))
-        buf.WriteString(" PayloadSz=")
-        buf.WriteString(strconv.Itoa(int(m.sz)))
-    } else if m.opcode == 4 {
-        buf.WriteString("<")
-        buf.WriteString("ACK")
-        buf.WriteString(">")
-        buf.WriteString(" Block=")
-        buf.WriteString(strconv.Itoa(int(m.block)))
-    } else if m.opcode == 5 {
-        buf.WriteString("<")
-        buf.WriteString("ERR")
-        buf.WriteString(">")
-    } else {
-        // Ignore
+// ---------------------------------
+// Filename Policy
+// ---------------------------------
+// Requested filenames are validated and normalized in the control loop before
+// a session is started, so both the stored key and the key looked up by RRQ
+// go through the very same rules. Rejected names get an ERROR back
+var stripLeadingSlash = flag.Bool("strip-leading-slash", true, "strip leading '/' from requested filenames")
+var collapseDots = flag.Bool("collapse-dots", true, "collapse '.' and '..' path segments, when off '..' is rejected")
+var rejectControl = flag.Bool("reject-control", true, "reject filenames containing control characters")
+var foldCase = flag.Bool("fold-case", false, "lower-case requested filenames")
+var maxFilename = flag.Int("max-filename", 255, "maximum length of a requested filename in bytes")
+
+func normalize_filename(name string) (key string, err error) {
+    if len(name) == 0 {
+        return "", fmt.Errorf("empty filename")
     }
-    buf.WriteString(" ]")
-    return buf.String()
-}
-    
-func Decode(buf *bytes.Buffer) (m *Message) {
-    m = new(Message)
-
-    var opcode uint16
-    binary.Read(buf, binary.BigEndian, &opcode);
-    m.opcode = opcode
-    if opcode == 1 {
-        key, _ := buf.ReadString(byte(0));
-        m.key = key
-    } else if opcode == 2 {
-        key, _ := buf.ReadString(byte(0));
-        m.key = key
-    } else if opcode == 3 {
-        err := binary.Read(buf, binary.BigEndian, &m.block);
-        chk_err(err)
-        sz, err := buf.Read(m.payload[0:chunk_sz])
-        if err != nil && err == io.EOF {
-            m.sz = 0
-        } else {
-            chk_err(err)
-            m.sz = sz
-        }
-    } else if opcode == 4 {
-        binary.Read(buf, binary.BigEndian, &m.block);
-    } else if opcode == 5 {
-        errmsg, _ := buf.ReadString(byte(0));
-        m.errmsg = errmsg
-    } else {
-        errmsg, _ := buf.ReadString(byte(0));
-        m.errmsg = errmsg
+    if len(name) > *maxFilename {
+        return "", fmt.Errorf("filename longer than %d bytes", *maxFilename)
+    }
+    if *rejectControl == true {
+        for i := 0; i < len(name); i++ {
+            if name[i] < 0x20 || name[i] == 0x7f {
+                return "", fmt.Errorf("control character in filename")
+            }
+        }
     }
 
-    return m
-}
-
-func Encode(m *Message) (buf *bytes.Buffer) {
-    buf = new(bytes.Buffer)
+    rooted := strings.HasPrefix(name, "/")
+    if *stripLeadingSlash == true {
+        name = strings.TrimLeft(name, "/")
+        rooted = false
+    }
 
-    opcode := m.opcode
-    binary.Write(buf, binary.BigEndian, uint16(m.opcode))
-    if opcode == 1 {
-        _, err := buf.Write([]byte(m.key))
-        chk_err(err)
-    } else if opcode == 2 {
-        _, err := buf.Write([]byte(m.key))
-        chk_err(err)
-    } else if opcode == 3 {
-        err := binary.Write(buf, binary.BigEndian, uint16(m.block))
-        chk_err(err)
-        _, err = buf.Write([]byte(m.payload[0:m.sz]))
-        chk_err(err)
-    } else if opcode == 4 {
-        err := binary.Write(buf, binary.BigEndian, uint16(m.block))
-        chk_err(err)
-    } else if opcode == 5 {
-        _, err := buf.Write([]byte("NODATA"))
-        chk_err(err)
+    segments := strings.Split(name, "/")
+    if *collapseDots == true {
+        kept := make([]string, 0, len(segments))
+        for _, seg := range segments {
+            if seg == "" || seg == "." {
+                continue
+            } else if seg == ".." {
+                if len(kept) == 0 {
+                    return "", fmt.Errorf("filename escapes the root")
+                }
+                kept = kept[0:len(kept) - 1]
+            } else {
+                kept = append(kept, seg)
+            }
+        }
+        segments = kept
     } else {
-        _, err := buf.Write([]byte("NODATA"))
-        chk_err(err)
+        for _, seg := range segments {
+            if seg == ".." {
+                return "", fmt.Errorf("'..' not allowed in filename")
+            }
+        }
     }
 
-    return buf
+    key = strings.Join(segments, "/")
+    if rooted == true {
+        key = "/" + key
+    }
+    if *foldCase == true {
+        key = strings.ToLower(key)
+    }
+    if key == "" || key == "/" {
+        return "", fmt.Errorf("empty filename")
+    }
+    return key, nil
 }
 
 // ---------------------------------
 // TFTP Control Service
 // ---------------------------------
 var doTest = flag.Bool("test", false, "run sample messaging")
+var storeMode = flag.String("store", "copy", "file store mode : copy | dedup")
+var aclFile = flag.String("acl", "", "file with access control rules, one per line")
+var aclDefault = flag.String("acl-default", "allow", "decision when no acl rule matches : allow | deny")
+var serverMode = flag.String("server-mode", "normal", "normal | read-only | write-only | maintenance")
+var adminAddr = flag.String("admin-addr", "", "address of the admin control channel ( host:port or unix socket path ), empty disables")
+var ctlCommand = flag.String("ctl", "", "send a command to the admin control channel of a running server and exit")
+
+var server_log = new_logger("SERVER")
 
 func main() {
     flag.Parse()
+    chk_err(setup_logging())
 
-    // Control Server UDP Socket
-    serveraddr, err := net.ResolveUDPAddr("udp", control_port)
+    // Client Commands
+    if flag.NArg() > 0 {
+        os.Exit(run_client_command(flag.Args()))
+    }
+
+    // Admin Client
+    if *ctlCommand != "" {
+        addr := *adminAddr
+        if addr == "" {
+            addr = default_admin_addr
+        }
+        if admin_ctl(addr, *ctlCommand) == false {
+            os.Exit(1)
+        }
+        return
+    }
+
+    // Audit Log Verification
+    if *auditVerify != "" {
+        f, err := os.Open(*auditVerify)
+        chk_err(err)
+        n, err := verify_audit(f)
+        f.Close()
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "%s : %d valid records, then %s\n", *auditVerify, n, err.Error())
+            os.Exit(1)
+        }
+        fmt.Printf("%s : %d records, chain intact\n", *auditVerify, n)
+        return
+    }
+
+    // Server Mode
+    chk_err(set_server_mode(*serverMode))
+
+    // File Store
+    if *storeMode == "dedup" {
+        filestore.dedup = true
+    } else if *storeMode != "copy" {
+        chk_err(fmt.Errorf("unknown store mode %q", *storeMode))
+    }
+    if *indexFormat != "text" && *indexFormat != "json" {
+        chk_err(fmt.Errorf("unknown index format %q", *indexFormat))
+    }
+
+    // Access Control
+    if *aclDefault == "deny" {
+        acl.default_allow = false
+    } else if *aclDefault != "allow" {
+        chk_err(fmt.Errorf("unknown acl default %q", *aclDefault))
+    }
+    if *aclFile != "" {
+        chk_err(load_acl(*aclFile))
+    }
+    chk_err(load_ban_allow(*banAllow))
+
+    // Admin Control Channel
+    if *adminAddr != "" {
+        chk_err(start_admin(*adminAddr))
+    }
+
+    // HTTP Admin API
+    if *httpAddr != "" {
+        chk_err(start_http(*httpAddr))
+    }
+    if *metricsAddr != "" {
+        chk_err(start_metrics(*metricsAddr))
+    }
+
+    // Network Impairment
+    imp, err := parse_impairment(*impairSpec)
     chk_err(err)
-    serverconn, err := net.ListenUDP("udp", serveraddr)
+    if imp != nil {
+        server_log.warnf("Impairing every packet sent : %s", imp.String())
+        set_server_impairment(imp)
+    }
+
+    // Control Server UDP Socket
+    srv, err := start_server(control_port)
     chk_err(err)
+    if *auditLog != "" {
+        chk_err(start_audit(*auditLog))
+    }
+    if *pcapFile != "" {
+        chk_err(start_capture(*pcapFile, srv.addr))
+    }
 
-    // Test Messages
+    // Test Messages, the process exits with their outcome
     if *doTest == true {
-        // < TESTING MESSAGES >
-        // go test_rw("key_511", 511, 1)
-        go test_rw("key_511", 511, 10)
-        go test_rw("key_512", 512, 10)
-        go test_rw("key_513", 513, 10)
-        go test_rw("key_99845", 99845, 2)
-        // < TESTING MESSAGES >
+        go func() {
+            os.Exit(run_self_test(srv.addr.String()))
+        }()
     }
 
-    // Control Loop
+    chk_err(srv.serve())
+}
+
+// ---------------------------------
+// Control Server
+// ---------------------------------
+// The control socket receiving RRQ/WRQ, every request admitted gets a session
+// with a socket of its own
+type Server struct {
+    conn net.PacketConn
+    addr *net.UDPAddr
+}
+
+// Binds the control socket to addr, port 0 picks a free port
+func start_server(addr string) (s *Server, err error) {
+    serveraddr, err := net.ResolveUDPAddr("udp", addr)
+    if err != nil {
+        return nil, err
+    }
+    conn, err := net.ListenUDP("udp", serveraddr)
+    if err != nil {
+        return nil, err
+    }
+    s = new(Server)
+    s.conn = impair_conn(conn, get_server_impairment())
+    s.addr = conn.LocalAddr().(*net.UDPAddr)
+    return s, nil
+}
+
+// Stops the control loop, sessions under way run to their end
+func (s *Server) close() {
+    s.conn.Close()
+}
+
+// Runs the control loop until the server is closed
+func (s *Server) serve() (error) {
+    serverconn := s.conn
+    serveraddr := s.addr
     for {
         // == recvmsg == ( IO BLOCK )
         var buffer [1500]byte;
-        n, clientaddr, err := serverconn.ReadFromUDP(buffer[0:])
-        chk_err(err)
-        trace("[SERVER] <read> : data=%s, bytes=%d, src=%s\n", string(buffer[0:n]), n, clientaddr.String())
+        n, clientaddr, err := read_udp(serverconn, buffer[0:])
+        if errors.Is(err, net.ErrClosed) == true {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if is_banned(clientaddr.IP) {
+            count("banned_packets_dropped")
+            continue
+        }
+        server_log.packetf("<read> : data=%s, bytes=%d, src=%s", payload(buffer[0:n]), n, clientaddr.String())
 
         // decode the message
-        datain := Decode(bytes.NewBuffer(buffer[0:n]))
-        trace("[SERVER] <message-in>:%s\n", datain.String())
+        datain, err := tftp.Decode(bytes.NewBuffer(buffer[0:n]))
+        if err != nil {
+            capture_packet(serveraddr, clientaddr, true, "", buffer[0:n])
+            server_log.warnf("%s, src=%s", err.Error(), clientaddr.String())
+            record_offense(clientaddr.IP, "malformed")
+            continue
+        }
+        capture_packet(serveraddr, clientaddr, true, datain.Key, buffer[0:n])
+        server_log.debugf("<message-in>:%s", datain.String())
 
         // orchestrate
-        if datain.opcode == 1 {
-            go wrq_session(datain, clientaddr)
-        } else if datain.opcode == 2 {
-            go rrq_session(datain, clientaddr)
+        if datain.Opcode == 1 || datain.Opcode == 2 {
+            if admit_request(serverconn, datain, clientaddr) == false {
+                continue
+            }
+            go func(m *tftp.Message, clientaddr *net.UDPAddr) {
+                defer release_session(clientaddr.IP.String())
+                start := time.Now()
+                completed := false
+                if m.Opcode == 1 {
+                    completed = wrq_session(m, clientaddr)
+                } else {
+                    completed = rrq_session(m, clientaddr)
+                }
+                typ := opcode_name(m.Opcode)
+                metric_session_duration.observe(time.Since(start).Seconds(), typ)
+                if completed == false {
+                    metric_sessions.inc(typ, "failed")
+                } else {
+                    metric_sessions.inc(typ, "completed")
+                }
+            }(datain, clientaddr)
         } else {
-            trace("[SERVER] %s\n", "Invalid Request For Control Loop")
+            server_log.warnf("Invalid Request For Control Loop")
+            record_offense(clientaddr.IP, "malformed")
         }
     }
 }
 
+// Audits a refused request and answers it with an ERROR
+func refuse(serverconn net.PacketConn, datain *tftp.Message, clientaddr *net.UDPAddr, code uint16, msg string) {
+    audit_refused(datain, clientaddr, code, msg)
+    answer(serverconn, datain, clientaddr, code, msg)
+}
+
+// Sends the ERROR of a refused request, unless the source has used up its
+// budget for responses to unverified peers
+func answer(serverconn net.PacketConn, datain *tftp.Message, clientaddr *net.UDPAddr, code uint16, msg string) {
+    if charge_unverified(clientaddr.IP.String(), tftp.DataHeaderBytes + len(msg) + 1) == false {
+        server_log.warnf("Response budget exhausted, not answering src=%s", clientaddr.String())
+        return
+    }
+    send_error(serverconn, clientaddr, datain.Key, code, msg, server_log)
+}
+
+// Admission of a new RRQ/WRQ : rate limits, server mode, filename policy,
+// access control and session caps. Normalizes the key of the request in
+// place. When refused, the peer is sent an ERROR and false is returned,
+// otherwise a session slot has been reserved for the peer
+func admit_request(serverconn net.PacketConn, datain *tftp.Message, clientaddr *net.UDPAddr) (bool) {
+    ip := clientaddr.IP.String()
+    opname := opcode_name(datain.Opcode)
+
+    if allow_request(ip) == false {
+        server_log.warnf("Rate limit exceeded, src=%s", clientaddr.String())
+        metric_requests.inc(opname, "rate_limited")
+        audit_rate_limited(clientaddr)
+        answer(serverconn, datain, clientaddr, tftp.NotDefined, "Rate limit exceeded, please slow down")
+        return false
+    }
+
+    if ok, code, msg := check_server_mode(datain.Opcode); ok == false {
+        server_log.warnf("Refusing %s in %s mode", datain.String(), get_server_mode())
+        metric_requests.inc(opname, "server_mode")
+        refuse(serverconn, datain, clientaddr, code, msg)
+        return false
+    }
+
+    key, err := normalize_filename(datain.Key)
+    if err != nil {
+        server_log.warnf("Rejecting filename %q : %s", datain.Key, err.Error())
+        metric_requests.inc(opname, "bad_filename")
+        record_offense(clientaddr.IP, "access_violation")
+        refuse(serverconn, datain, clientaddr, tftp.AccessViolation, err.Error())
+        return false
+    }
+    if _, is_index := index_prefix(key); is_index == true && datain.Opcode == 1 {
+        server_log.warnf("Rejecting WRQ for reserved index filename %q", key)
+        metric_requests.inc(opname, "bad_filename")
+        record_offense(clientaddr.IP, "access_violation")
+        refuse(serverconn, datain, clientaddr, tftp.AccessViolation, "reserved filename")
+        return false
+    }
+    datain.Key = key
+
+    op := "read"
+    if datain.Opcode == 1 {
+        op = "write"
+    }
+    if acl_allows(clientaddr.IP, op, key) == false {
+        server_log.warnf("ACL denied %s of %q to %s", op, key, clientaddr.String())
+        metric_requests.inc(opname, "acl_denied")
+        record_offense(clientaddr.IP, "access_violation")
+        refuse(serverconn, datain, clientaddr, tftp.AccessViolation, "Access violation")
+        return false
+    }
+
+    if ok, reason := acquire_session(ip); ok == false {
+        server_log.warnf("Session cap reached, src=%s : %s", clientaddr.String(), reason)
+        metric_requests.inc(opname, "session_cap")
+        refuse(serverconn, datain, clientaddr, tftp.NotDefined, reason)
+        return false
+    }
+    metric_requests.inc(opname, "accepted")
+    return true
+}
+
 // ---------------------------------
 // WRQ Session Handler
 // ---------------------------------
 type FileTransferStateIn struct {
-    buf bytes.Buffer
+    file *FileWriter
     last_block_received uint16
 }
 
-func wrq_session(m *Message, clientaddr *net.UDPAddr) {
-    trace("[WRQ-HANDLER] src=%s message-in=%s\n", clientaddr.String(), m.String())
+var wrq_log = new_logger("WRQ")
+
+func wrq_session(m *tftp.Message, clientaddr *net.UDPAddr) (completed bool) {
+    audit := new_transfer_audit("write", m.Key, clientaddr)
+    defer func() { audit.done(completed) }()
 
     // 1. bind a new udp socket ( ListenUDP ) this is our new 'endpoint' for the session
-    tid := get_random_tid()
-    sessionaddr, err := net.ResolveUDPAddr("udp", tid)
-    chk_err(err)
-    sessionconn, err := net.ListenUDP("udp", sessionaddr)
-    chk_err(err)
+    sessionconn, err := open_session_conn()
+    if err != nil {
+        wrq_log.errorf("unable to open session socket : %s", err.Error())
+        audit.fail(err)
+        return false
+    }
+    defer sessionconn.Close()
+    sessionaddr := sessionconn.LocalAddr().(*net.UDPAddr)
 
     s_tag := get_session_tag(clientaddr, sessionaddr)
-    trace("[WRQ (%s)] Starting WRQ Session\n", s_tag)
-
-    // 2. send the initial ACK for WRQ transfer initiate
-    first_ack := new(Message)
-    first_ack.opcode = 4
-    first_ack.block = 0
-    encoded_first_ack := Encode(first_ack)
-    n, err := sessionconn.WriteToUDP(encoded_first_ack.Bytes(), clientaddr) 
-    chk_err(err)
-    trace("[WRQ (%s)] <send> : message-out=%s, bytes=%d, src=%s, dst=%s\n", s_tag, first_ack.String(), n, sessionaddr.String(), clientaddr.String());
-
-    // 3. Read DATA Blocks
+    session := register_session("WRQ", m.Key, clientaddr.String(), sessionaddr.String())
+    defer unregister_session(session)
+    audit.attach(session)
+    log := wrq_log.with("session", session.info.Id).with("tid", s_tag)
+    e := new_endpoint(sessionconn, clientaddr, log, session)
+    session.on_cancel(e.cancel)
+    log.infof("Starting WRQ Session, src=%s, message-in=%s", clientaddr.String(), m.String())
+
+    // 2. send the initial ACK for WRQ transfer initiate, or the OACK when
+    // options were negotiated. An upload with a token goes on with what an
+    // earlier session of it kept, if any, the OACK tells the peer how much
     transfer_state := new(FileTransferStateIn)
-    completed := false
+    transfer_state.file = new_file_writer()
+    oack := negotiate_options(m, e, nil)
+    token := upload_token(m)
+    if token != "" {
+        if file := take_partial(token, m.Key, clientaddr.IP); file != nil {
+            log.infof("Resuming upload at offset %d, Key=%s", file.sz, m.Key)
+            transfer_state.file = file
+            audit.resume(file.sz)
+        }
+        if oack == nil {
+            oack = new(tftp.Message)
+            oack.Opcode = 6
+            oack.Options = make(map[string]string)
+        }
+        oack.Options["token"] = token
+        oack.Options["offset"] = strconv.Itoa(transfer_state.file.sz)
+        // whatever happens from now on, the client may come back for it
+        defer func() {
+            if completed == false {
+                retain_partial(token, m.Key, clientaddr.IP, transfer_state.file)
+            }
+        }()
+    }
+    if oack != nil {
+        session.set_state("negotiating")
+        err = e.send(oack)
+    } else {
+        err = e.send(tftp.NewAck(0))
+    }
+    if err != nil {
+        log.warnf("Terminating WRQ Session : %s", err.Error())
+        audit.fail(err)
+        return false
+    }
+
+    // 3. Read DATA Blocks, a window of blocks is acknowledged at once. A
+    // block out of sequence means something was lost or duplicated, the
+    // last block received in sequence is acknowledged so the peer goes on
+    // from there. Only once for the rest of the window, but again when the
+    // peer starts over with an earlier block, its retransmission
+    session.set_state("transferring")
     datain_bytes := 0
+    in_window := 0
+    nacked := false
+    var nacked_at uint16
     for {
-        trace("[WRQ (%s)] %s\n", s_tag, "Waiting on WRQ session loop")
+        log.debugf("Waiting on WRQ session loop")
 
         // == recvmsg == ( IO BLOCK : wait for data packets )
-        var buffer [1500]byte;
-        received_bytes, clientaddr, err := sessionconn.ReadFromUDP(buffer[0:])
-        chk_err(err)
-        trace("[WRQ (%s)] <read> : data=%s, bytes=%d, src=%s\n", s_tag, base64.URLEncoding.EncodeToString(buffer[0:received_bytes]), received_bytes, clientaddr.String())
-
-        // [TODO] validate clientaddr to ensure no cross-talk among sessions ( ignoring for now )
-
-        // decode the packet
-        datain := Decode(bytes.NewBuffer(buffer[0:received_bytes]))
-        trace("[WRQ (%s)] <message-in>:%s\n", s_tag, datain.String())
-
-        // collect the data
-        if datain.opcode == 3 {
-            trace("[WRQ (%s)] %s\n", s_tag, "GOT DATA!!")
-
-            if datain.block != transfer_state.last_block_received + 1 {
-                trace("[WRQ (%s)] Block Sequence Error, Actual=%d, Expected=%d, Message=%s\n", s_tag, datain.block, transfer_state.last_block_received + 1, datain.String())
-
-                // send ack
-                er := new(Message)
-                er.opcode = 5
-                er.errmsg = "Invalid Block Sequence"
-                encoded_er := Encode(er)
-                n, err := sessionconn.WriteToUDP(encoded_er.Bytes(), clientaddr) 
-                chk_err(err)
-                trace("[WRQ (%s)] <send> : message-out=%s, bytes=%d, src=%s, dst=%s\n", s_tag, er.String(), n, sessionaddr.String(), clientaddr.String());
+        expected := transfer_state.last_block_received + 1
+        datain, err := e.receive(func(d *tftp.Message) bool { return d.Opcode == 3 })
+        if err != nil {
+            log.warnf("Terminating WRQ Session : %s", err.Error())
+            audit.fail(err)
+            break
+        }
 
-                trace("[WRQ (%s)] Terminating WRQ Session", s_tag)
-                break;
+        if datain.Block != expected {
+            if nacked == true && tftp.BlockAfter(datain.Block, nacked_at) == true {
+                continue
             }
-
-            // append/store data in temp buffer
-            transfer_state.buf.Write(datain.payload[:])
-            transfer_state.last_block_received = datain.block
-            datain_bytes += datain.sz
-
-            // send ack
-            ack := new(Message)
-            ack.opcode = 4
-            ack.block = datain.block
-            encoded_ack := Encode(ack)
-            n, err := sessionconn.WriteToUDP(encoded_ack.Bytes(), clientaddr) 
-            chk_err(err)
-            trace("[WRQ (%s)] <send> : message-out=%s, bytes=%d, src=%s, dst=%s\n", s_tag, ack.String(), n, sessionaddr.String(), clientaddr.String());
-
-            // If EOF, complete the file storage transaction
-            if received_bytes < ( chunk_sz + tftp_data_header_bytes ) {
-                completed = true
+            // our last ACK got lost and the peer sent the previous window
+            // again, or a block of this window got lost
+            log.infof("Out of sequence DATA Block=%d, Expected=%d, acknowledging Block=%d again", datain.Block, expected, expected - 1)
+            nacked = true
+            nacked_at = datain.Block
+            in_window = 0
+            err = e.send(tftp.NewAck(expected - 1))
+            if err != nil {
+                log.warnf("Terminating WRQ Session : %s", err.Error())
+                audit.fail(err)
                 break
             }
-        } else {
-            trace("[WRQ (%s)] %s\n", s_tag, "Invalid Request For Control Loop")
+            continue
+        }
+        nacked = false
+
+        // append/store data in temp segments
+        transfer_state.file.write(datain.Payload[0:datain.Sz])
+        transfer_state.last_block_received = datain.Block
+        datain_bytes += datain.Sz
+        session.progress(datain.Block, datain.Sz)
+        in_window++
+
+        // If EOF, complete the file storage transaction
+        eof := datain.Sz < e.blksize
+        if eof == false && in_window < e.windowsize {
+            continue
+        }
+
+        // send ack
+        in_window = 0
+        err = e.send(tftp.NewAck(datain.Block))
+        if err != nil {
+            log.warnf("Terminating WRQ Session : %s", err.Error())
+            audit.fail(err)
+            break
+        }
+        if eof == true {
+            completed = true
+            break
         }
     }
 
     // [TODO] last ack can signify error if unable to store ( ignoring for now )
     if completed == true {
-        trace("[WRQ (%s)] data receieved fully, storing file Key=%s\n", s_tag, m.key)
+        log.debugf("data receieved fully, storing file Key=%s", m.Key)
 
         // store the file
-        trace("[WRQ (%s)] Received : [ %d ] %s\n", s_tag, datain_bytes, base64.URLEncoding.EncodeToString(transfer_state.buf.Bytes()[0:datain_bytes]))
-        put(m.key, transfer_state.buf.Bytes()[0:datain_bytes])
-
-        trace("[WRQ (%s)] COMPLETED, File=%s\n", s_tag, m.key)
+        file := transfer_state.file.close()
+        log.debugf("Received : [ %d ] Segments=%d, Hash=%x", datain_bytes, len(file.segs), file.hash)
+        put(m.Key, file)
+        audit.content(file.hash)
+
+        log.infof("COMPLETED, File=%s", m.Key)
+        session.set_state("dallying")
+        e.dally(transfer_state.last_block_received)
     }
+    return completed
 }
 
 // ---------------------------------
 // RRQ Session Handler
 // ---------------------------------
-func rrq_session(m *Message, clientaddr *net.UDPAddr) {
-    trace("[RRQ-HANDLER] src=%s message-in=%s\n", clientaddr.String(), m.String())
+var rrq_log = new_logger("RRQ")
+
+func rrq_session(m *tftp.Message, clientaddr *net.UDPAddr) (completed bool) {
+    audit := new_transfer_audit("read", m.Key, clientaddr)
+    defer func() { audit.done(completed) }()
 
     // 1. bind a new udp socket ( ListenUDP ) this is our new 'endpoint' for the session
-    tid := get_random_tid()
-    sessionaddr, err := net.ResolveUDPAddr("udp", tid)
-    chk_err(err)
-    sessionconn, err := net.ListenUDP("udp", sessionaddr)
-    chk_err(err)
+    sessionconn, err := open_session_conn()
+    if err != nil {
+        rrq_log.errorf("unable to open session socket : %s", err.Error())
+        audit.fail(err)
+        return false
+    }
+    defer sessionconn.Close()
+    sessionaddr := sessionconn.LocalAddr().(*net.UDPAddr)
 
     s_tag := get_session_tag(clientaddr, sessionaddr)
-    trace("[RRQ (%s)] Starting WRQ Session\n", s_tag)
+    session := register_session("RRQ", m.Key, clientaddr.String(), sessionaddr.String())
+    defer unregister_session(session)
+    audit.attach(session)
+    log := rrq_log.with("session", session.info.Id).with("tid", s_tag)
+    e := new_endpoint(sessionconn, clientaddr, log, session)
+    session.on_cancel(e.cancel)
+    log.infof("Starting RRQ Session, src=%s, message-in=%s", clientaddr.String(), m.String())
 
     // validate if file is present else respond with error
-    // payload_sz := chunk_sz
-    // payload := generate_random_bytes(payload_sz)
-    // key := "key-1"
-    key := m.key
+    key := m.Key
     file, ok := get(key)
+    if prefix, is_index := index_prefix(key); is_index == true {
+        file, ok = build_index(prefix, clientaddr.IP), true
+        log.infof("Serving generated index, Prefix=%s, Size=%d", prefix, file.sz)
+    }
+    if ok == true {
+        audit.content(file.hash)
+    }
     // if not ok, then send an err packet and abort
     if ok == false {
-        trace("[RRQ (%s)] File not present, abort\n", s_tag)
-        return
+        log.warnf("File not present, abort")
+        e.send_error(tftp.FileNotFound, "File not found")
+        audit.abort(tftp.FileNotFound, "File not found")
+        return false
     }
-    payload := file.buf
-    payload_sz := file.sz
 
-    // send data
-    completed := false
-    send_zero_eof := false
-    remaining := payload_sz;
-    st := 0
-    en := 0
-    var block uint16 = 0
+    // 2. negotiate options, an OACK has to be acknowledged before any DATA
+    // goes out which proves the peer is not a spoofed source
+    oack := negotiate_options(m, e, file)
+    if oack == nil && *rrqHandshakeSize > 0 && file.sz > *rrqHandshakeSize {
+        log.warnf("Refusing %d bytes without option negotiation, File=%s", file.sz, key)
+        count("amp_handshake_refused")
+        msg := fmt.Sprintf("Files larger than %d bytes require option negotiation ( e.g. tsize )", *rrqHandshakeSize)
+        e.send_error(tftp.NotDefined, msg)
+        audit.abort(tftp.NotDefined, msg)
+        return false
+    }
+    if oack != nil {
+        session.set_state("negotiating")
+        err = e.send(oack)
+        if err == nil {
+            _, err = e.receive(func(d *tftp.Message) bool { return d.Opcode == 4 && d.Block == 0 })
+        }
+        if err != nil {
+            log.warnf("Terminating RRQ Session : %s", err.Error())
+            audit.fail(err)
+            return false
+        }
+    }
+
+    // 3. send DATA blocks a window at a time, the window is retransmitted
+    // until some of it is acked and then slides past the acked blocks. Block
+    // numbers roll over to 0 past 65535
+    session.set_state("transferring")
+    off := e.offset
+    if off > 0 {
+        log.infof("Resuming at offset %d of %d, Key=%s", off, file.sz, key)
+        audit.resume(off)
+    }
+    var base uint16 = 1
     for {
-        block = block + 1
-
-        dataout := new(Message)
-        dataout.opcode = 3
-        dataout.block = block
-
-        // determine chunk to send
-        if send_zero_eof == true {
-            dataout.sz = 0
-            var emptybuf [0]byte
-            copy(dataout.payload[0:], emptybuf[0:0])
-            trace("[RRQ (%s)] preparing to send zero packet eof : Block=%d\n", s_tag, block)
-        } else {
-            st = en
-            if (st + chunk_sz) < (st + remaining) {
-                en = st + chunk_sz
-            } else {
-                en = st + remaining
+        window := make([]*tftp.Message, 0, e.windowsize)
+        end := off
+        for len(window) < e.windowsize {
+            dataout := new(tftp.Message)
+            dataout.Opcode = 3
+            dataout.Block = base + uint16(len(window))
+            dataout.Payload = make([]byte, e.blksize)
+            dataout.Sz = file.read_at(dataout.Payload, end)
+            log.debugf("preparing to send data chunk : St=%d, En=%d, Block=%d", end, end + dataout.Sz, dataout.Block)
+            end += dataout.Sz
+            window = append(window, dataout)
+            if dataout.Sz < e.blksize {
+                break
             }
-            trace("[RRQ (%s)] preparing to send data chunk : St=%d, En=%d, Block=%d\n", s_tag, st, en, block)
-
-            copy(dataout.payload[0:], payload[st:en])
-            dataout.sz = en - st
         }
 
-        encoded_dataout := Encode(dataout)
-        sent_bytes, err := sessionconn.WriteToUDP(encoded_dataout.Bytes(), clientaddr) 
-        chk_err(err)
-        trace("[RRQ (%s)] <send> : message-out=%s, bytes=%d, src=%s, dst=%s\n", s_tag, dataout.String(), sent_bytes, sessionaddr.String(), clientaddr.String());
-
-        remaining = remaining - dataout.sz
-        trace("[RRQ (%s)] Remaining=%d\n", s_tag, remaining)
-        if remaining <= 0 {
-            // if the last chunk is exactly 512 bytes, then we need to
-            // send a 0 byte payload to indicate EOF
-            if dataout.sz == chunk_sz {
-                send_zero_eof = true
-            } else {
-                completed = true
-                trace("[RRQ (%s)] all bytes sent out for File=%s\n", s_tag, key)
+        // an ACK of the block before the window says its first block was
+        // lost ( RFC 7440 ), the window goes again at once rather than after
+        // a timeout. Only once per window, a stale duplicate of that ACK must
+        // not set off another round
+        err := e.send_window(window)
+        var ack *tftp.Message
+        resent := false
+        for err == nil {
+            ack, err = e.receive(func(d *tftp.Message) bool {
+                return d.Opcode == 4 && int(d.Block - (base - 1)) <= len(window)
+            })
+            if err != nil || ack.Block != base - 1 {
+                break
+            }
+            if resent == false {
+                resent = true
+                log.infof("Block=%d was lost, sending the window again", base)
+                e.session.retransmitted()
+                metric_retransmissions.inc(e.session.info.Type)
+                count("retransmits")
+                err = e.resend()
             }
         }
+        if err != nil {
+            log.warnf("Terminating RRQ Session : %s", err.Error())
+            audit.fail(err)
+            return false
+        }
 
-        // wait for ack
-        var buffer [1500]byte;
-        n, session_src_addr, err := sessionconn.ReadFromUDP(buffer[0:])
-        chk_err(err)
-        trace("[RRQ (%s)] <read> : data=%s, bytes=%d, src=%s, dst=%s\n", s_tag, string(buffer[0:n]), n, session_src_addr.String(), sessionaddr.String())
-
-        datain := Decode(bytes.NewBuffer(buffer[0:n]))
-        trace("[RRQ (%s)] <message-in>:%s\n", s_tag, datain.String())
-
-        if datain.opcode == 4 {
-            trace("[RRQ (%s)] received ACK for sent DATA", s_tag)
+        acked := window[0:int(ack.Block - base) + 1]
+        for _, dataout := range acked {
+            off += dataout.Sz
+            session.progress(dataout.Block, dataout.Sz)
+        }
+        base += uint16(len(acked))
 
-            if completed == true {
-                // were waiting for the last ACK which we recieved
-                trace("[RRQ (%s)] COMPLETED : received last ack, Key=%s\n", s_tag, key)
-                break;
-            }
-            
-        } else {
-            trace("[RRQ (%s)] %s\n", s_tag, "Invalid Request For RRQ Session")
+        // a short block, possibly empty when the size is a multiple of the
+        // block size, marks the end of the file
+        if acked[len(acked) - 1].Sz < e.blksize {
+            log.infof("COMPLETED : received last ack, Key=%s", key)
+            return true
         }
     }
 }
@@ -414,310 +708,422 @@ func rrq_session(m *Message, clientaddr *net.UDPAddr) {
 // ---------------------------------
 // In-Memory File Storage ( concurrent-safe )
 // ---------------------------------
+// Files are kept as a list of fixed-size segments rather than one contiguous
+// buffer, so very large uploads never need a single huge allocation nor the
+// copy-on-grow of a bytes.Buffer. Once stored a file is immutable.
+//
+// Two modes are supported :
+// - copy  : every PUT keeps its own private copy of the payload ( default )
+// - dedup : content-addressed, payloads are kept once per SHA-256 as a blob
+//           and keys point to the blob. Blobs are reference counted and
+//           dropped as soon as the last key referring to them goes away
+const segment_sz int = 64 * 1024
+
 type File struct {
-    buf []byte
+    segs [][]byte
     sz int
+    hash [sha256.Size]byte
+    mtime time.Time
+}
+
+// Copies the bytes of the file starting at offset off into p, returns the
+// number of bytes copied ( less than len(p) only at the end of the file )
+func (f *File) read_at(p []byte, off int) (n int) {
+    for n < len(p) && off < f.sz {
+        seg := f.segs[off / segment_sz]
+        c := copy(p[n:], seg[off % segment_sz:])
+        n += c
+        off += c
+    }
+    return n
+}
+
+// Incrementally builds a File, segment by segment, hashing as it goes
+type FileWriter struct {
+    segs [][]byte
+    sz int
+    h hash.Hash
+}
+
+func new_file_writer() (w *FileWriter) {
+    w = new(FileWriter)
+    w.h = sha256.New()
+    return w
+}
+
+func (w *FileWriter) write(p []byte) {
+    w.h.Write(p)
+    w.sz += len(p)
+    for len(p) > 0 {
+        last := len(w.segs) - 1
+        if last < 0 || len(w.segs[last]) == segment_sz {
+            w.segs = append(w.segs, make([]byte, 0, segment_sz))
+            last++
+        }
+        c := segment_sz - len(w.segs[last])
+        if c > len(p) {
+            c = len(p)
+        }
+        w.segs[last] = append(w.segs[last], p[0:c]...)
+        p = p[c:]
+    }
+}
+
+func (w *FileWriter) close() (file *File) {
+    // don't keep a mostly empty tail segment around for the file's lifetime
+    last := len(w.segs) - 1
+    if last >= 0 && len(w.segs[last]) < segment_sz / 2 {
+        tail := make([]byte, len(w.segs[last]))
+        copy(tail, w.segs[last])
+        w.segs[last] = tail
+    }
+
+    f := new(File)
+    f.segs = w.segs
+    f.sz = w.sz
+    copy(f.hash[:], w.h.Sum(nil))
+    return f
+}
+
+type Blob struct {
+    segs [][]byte
+    sz int
+    refs int
 }
 
 var filestore = struct {
     sync.RWMutex
     t map[string]*File
-} { t : make(map[string]*File) }
+    dedup bool
+    blobs map[[sha256.Size]byte]*Blob
+} { t : make(map[string]*File), blobs : make(map[[sha256.Size]byte]*Blob) }
+
+var store_log = new_logger("FILESTORE")
 
 func create_file(payload []byte) (file *File) {
-    f := new(File)
-    f.buf = make([]byte, len(payload))
-    copy(f.buf, payload)
-    f.sz = len(payload)
-    return f
+    w := new_file_writer()
+    w.write(payload)
+    return w.close()
 }
 
-func put(key string, payload []byte) (bool) {
-    trace("[FILESTORE] Request to PUT file, Key=%s, Size=%d\n", key, len(payload))
+// Takes ownership of the file, callers must not modify it afterwards
+func put(key string, file *File) (bool) {
+    store_log.debugf("Request to PUT file, Key=%s, Size=%d", key, file.sz)
+    metric_store_ops.inc("put", "ok")
 
-    file := create_file(payload)
+    file.mtime = time.Now()
 
     filestore.Lock()
     defer filestore.Unlock()
 
+    if filestore.dedup == false {
+        filestore.t[key] = file
+        return true
+    }
+
+    blob, ok := filestore.blobs[file.hash]
+    if ok == true {
+        store_log.debugf("Dedup hit, Key=%s, Hash=%x, Refs=%d", key, file.hash, blob.refs + 1)
+        // share the existing segments, the new ones are left to the gc
+        stored := new(File)
+        stored.segs = blob.segs
+        stored.sz = blob.sz
+        stored.hash = file.hash
+        stored.mtime = file.mtime
+        file = stored
+    } else {
+        blob = new(Blob)
+        blob.segs = file.segs
+        blob.sz = file.sz
+        filestore.blobs[file.hash] = blob
+    }
+    blob.refs++
+
+    // the key may already point to a blob ( possibly the very same one )
+    if old, ok := filestore.t[key]; ok == true {
+        unref_blob(old.hash)
+    }
     filestore.t[key] = file
     return true
 }
 
 func get(key string) (file *File, exists bool) {
-    trace("[FILESTORE] Request to GET file, Key=%s\n", key)
+    store_log.debugf("Request to GET file, Key=%s", key)
 
     filestore.RLock()
     defer filestore.RUnlock()
 
     v, ok := filestore.t[key]
+    if ok == true {
+        metric_store_ops.inc("get", "hit")
+    } else {
+        metric_store_ops.inc("get", "miss")
+    }
     return v, ok
 }
 
-// ---------------------------------
-// Utilities
-// ---------------------------------
-func chk_err(err error) {
-    if err != nil {
-        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
-        os.Exit(1)
+func del(key string) (existed bool) {
+    store_log.debugf("Request to DELETE file, Key=%s", key)
+
+    filestore.Lock()
+    defer filestore.Unlock()
+
+    old, ok := filestore.t[key]
+    if ok == false {
+        metric_store_ops.inc("delete", "miss")
+        return false
+    }
+    metric_store_ops.inc("delete", "hit")
+    if filestore.dedup == true {
+        unref_blob(old.hash)
     }
+    delete(filestore.t, key)
+    return true
 }
 
-func trace(format string, v ...interface{}) {
-    log.Printf(format, v...)
-}
+// Metadata of a single key
+func stat(key string) (info FileInfo, exists bool) {
+    filestore.RLock()
+    defer filestore.RUnlock()
 
-func get_random_tid() (tid_port string) {
-    buf := new(bytes.Buffer)
-    buf.WriteString(":")
-    max := big.NewInt(5000);
-    portrange, _ := rand.Int(rand.Reader, max)
-    port := int(portrange.Uint64()) + 10000
-    buf.WriteString(strconv.Itoa(port))
-    return buf.String()
+    f, ok := filestore.t[key]
+    if ok == false {
+        return info, false
+    }
+    return FileInfo{ key, f.sz, f.mtime, fmt.Sprintf("%x", f.hash) }, true
 }
 
-func get_session_tag(src_addr *net.UDPAddr, dst_addr *net.UDPAddr) (tag string) {
-    buf := new(bytes.Buffer)
-    buf.WriteString(strings.Split(src_addr.String(), ":")[1])
-    buf.WriteString(":")
-    buf.WriteString(strings.Split(dst_addr.String(), ":")[1])
-    return buf.String()
+type FileInfo struct {
+    Key string `json:"key"`
+    Size int `json:"size"`
+    Mtime time.Time `json:"mtime"`
+    Hash string `json:"sha256"`
 }
 
+// Snapshot of the keys starting with prefix, sorted by key
+func list(prefix string) (infos []FileInfo) {
+    filestore.RLock()
+    for k, f := range filestore.t {
+        if strings.HasPrefix(k, prefix) {
+            infos = append(infos, FileInfo{ k, f.sz, f.mtime, fmt.Sprintf("%x", f.hash) })
+        }
+    }
+    filestore.RUnlock()
 
-// ---------------------------------
-// Test Clients For Read/Write
-// ---------------------------------
-func write_file(key string, payload_sz int) (string, bool) {
-
-    payload := generate_random_bytes(payload_sz)
-    hash := compute_sha1(payload)
-
-    // Setup a UDP socket on which we can listen for events
-    session_src_addr, err := net.ResolveUDPAddr("udp", "localhost:0")
-    chk_err(err)
-    session_src_conn, err := net.ListenUDP("udp", session_src_addr)
-    chk_err(err)
-
-    // send a WRQ message
-    msg := new(Message)
-    msg.opcode = 1
-    msg.key = key
-    encoded := Encode(msg)
-    server_control_addr, err := net.ResolveUDPAddr("udp", control_port)
-    chk_err(err)
-    n, err := session_src_conn.WriteToUDP(encoded.Bytes(), server_control_addr) 
-    chk_err(err)
-    trace("[CLIENT] <send> : message-out=%s, bytes=%d, src=%s, dst=%s\n", msg.String(), n, session_src_addr.String(), server_control_addr.String());
-
-    // write the data
-    completed := false
-    send_zero_eof := false
-    remaining := payload_sz;
-    st := 0
-    en := 0
-    s_tag := ""
-    for {
-        // wait and read the message
-        var buffer [1500]byte;
-        n, session_dst_addr, err := session_src_conn.ReadFromUDP(buffer[0:])
-        chk_err(err)
-        trace("[CLIENT] <read> : data=%s, bytes=%d, src=%s, dst=%s\n", string(buffer[0:n]), n, session_src_addr.String(), session_dst_addr.String())
-
-        s_tag = get_session_tag(session_src_addr, session_dst_addr)
-        trace("[CLIENT (%s)] Start writing data for WRQ session\n", s_tag)
-
-        datain := Decode(bytes.NewBuffer(buffer[0:n]))
-        trace("[CLIENT (%s)] <message-in>:%s\n", s_tag, datain.String())
-
-        if datain.opcode == 4 {
-            trace("%s\n", "[CLIENT (%s)] received ACK, Sending DATA", s_tag)
-
-            if completed == true {
-                // were waiting for the last ACK which we recieved
-                trace("%s\n", "[CLIENT (%s)] COMPLETED : received last ack, Key=%s\n", s_tag, key)
-                break;
-            }
-
-            dataout := new(Message)
-            dataout.opcode = 3
-            dataout.block = datain.block + 1
-
-            // determine chunk to send
-            if send_zero_eof == true {
-                dataout.sz = 0
-                var emptybuf [0]byte
-                copy(dataout.payload[0:], emptybuf[0:0])
-                trace("[CLIENT (%s)] preparing to send zero packet eof : Block=%d\n", s_tag, dataout.block)
-            } else {
-                st = en
-                if (st + chunk_sz) < (st + remaining) {
-                    en = st + chunk_sz
-                } else {
-                    en = st + remaining
-                }
-                trace("[CLIENT (%s)] preparing to send data chunk : St=%d, En=%d, Block=%d\n", s_tag, st, en, dataout.block)
+    sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+    return infos
+}
 
-                copy(dataout.payload[0:], payload[st:en])
-                dataout.sz = en - st
-            }
+// Must be called with the filestore write lock held. Readers which already
+// hold a *File keep the underlying bytes alive, so dropping the blob here
+// never pulls data away from an in-flight RRQ session
+func unref_blob(hash [sha256.Size]byte) {
+    blob, ok := filestore.blobs[hash]
+    if ok == false {
+        return
+    }
+    blob.refs--
+    if blob.refs <= 0 {
+        store_log.debugf("Collecting unreferenced blob, Hash=%x, Size=%d", hash, blob.sz)
+        delete(filestore.blobs, hash)
+    }
+}
 
-            encoded_dataout := Encode(dataout)
-            sent_bytes, err := session_src_conn.WriteToUDP(encoded_dataout.Bytes(), session_dst_addr) 
-            chk_err(err)
-            trace("[CLIENT (%s)] <send> : message-out=%s, bytes=%d, src=%s, dst=%s\n", s_tag, dataout.String(), sent_bytes, session_src_addr.String(), session_dst_addr.String());
-
-            remaining = remaining - dataout.sz
-            trace("[CLIENT (%s)] Remaining=%d\n", s_tag, remaining)
-            if remaining <= 0 {
-                // if the last chunk is exactly 512 bytes, then we need to
-                // send a 0 byte payload to indicate EOF
-                if dataout.sz == chunk_sz {
-                    send_zero_eof = true
-                } else {
-                    completed = true
-                    trace("[CLIENT (%s)] all bytes sent out for File=%s\n", s_tag, key)
-                }
-            }
+// Returns the number of keys, the logical bytes ( sum of all file sizes ) and
+// the physical bytes actually held in memory
+func store_stats() (keys int, logical_bytes int, physical_bytes int) {
+    filestore.RLock()
+    defer filestore.RUnlock()
 
-        } else {
-            trace("[%s] %s\n", "CLIENT", s_tag, "Invalid Request For Control Loop")
+    for _, f := range filestore.t {
+        logical_bytes += f.sz
+    }
+    if filestore.dedup == true {
+        for _, b := range filestore.blobs {
+            physical_bytes += b.sz
         }
+    } else {
+        physical_bytes = logical_bytes
     }
-
-    return hash, true
+    return len(filestore.t), logical_bytes, physical_bytes
 }
 
-func read_file(key string) (hash string, ok bool) {
-
-    // Setup a UDP socket on which we can listen for events
-    session_src_addr, err := net.ResolveUDPAddr("udp", "localhost:0")
-    chk_err(err)
-    session_src_conn, err := net.ListenUDP("udp", session_src_addr)
-    chk_err(err)
-
-    // send a RRQ message
-    msg := new(Message)
-    msg.opcode = 2
-    msg.key = key
-    encoded := Encode(msg)
-    server_control_addr, err := net.ResolveUDPAddr("udp", control_port)
-    chk_err(err)
-    n, err := session_src_conn.WriteToUDP(encoded.Bytes(), server_control_addr) 
-    chk_err(err)
-    trace("[CLIENT] <send> : message-out=%s, bytes=%d, src=%s, dst=%s\n", msg.String(), n, session_src_addr.String(), server_control_addr.String());
+// ---------------------------------
+// Virtual Directory Index
+// ---------------------------------
+// TFTP has no LIST, so a reserved filename is served by RRQ as a listing of
+// the store generated at request time. "<index>" lists every key and
+// "dir/<index>" lists the keys under "dir/". The index is never stored and
+// only lists the keys the requesting peer is allowed to read
+var indexName = flag.String("index-name", ".index", "reserved filename served as a listing of the store, empty disables")
+var indexFormat = flag.String("index-format", "text", "format of the generated listing : text | json")
+
+func index_prefix(key string) (prefix string, ok bool) {
+    if *indexName == "" {
+        return "", false
+    }
+    if key == *indexName {
+        return "", true
+    }
+    if strings.HasSuffix(key, "/" + *indexName) {
+        return key[0:len(key) - len(*indexName)], true
+    }
+    return "", false
+}
 
-    // receive data
-    transfer_state := new(FileTransferStateIn)
-    completed := false
-    datain_bytes := 0
-    s_tag := ""
-    for {
-        trace("[CLIENT] %s\n", "waiting for DATA to arrive for RRQ")
+func build_index(prefix string, ip net.IP) (file *File) {
+    infos := make([]FileInfo, 0)
+    for _, fi := range list(prefix) {
+        if acl_allows(ip, "read", fi.Key) {
+            infos = append(infos, fi)
+        }
+    }
 
-        // == recvmsg == ( IO BLOCK : wait for data packets )
-        var buffer [1500]byte;
-        received_bytes, serveraddr, err := session_src_conn.ReadFromUDP(buffer[0:])
+    buf := new(bytes.Buffer)
+    if *indexFormat == "json" {
+        err := json.NewEncoder(buf).Encode(infos)
         chk_err(err)
-        trace("[CLIENT] <read> : data=%s, bytes=%d, src=%s\n", base64.URLEncoding.EncodeToString(buffer[0:received_bytes]), received_bytes, serveraddr.String())
-
-        s_tag = get_session_tag(session_src_addr, serveraddr)
-        trace("[CLIENT (%s)] Start reading data for RRQ session\n", s_tag)
+    } else {
+        for _, fi := range infos {
+            fmt.Fprintf(buf, "%d\t%s\t%s\t%s\n", fi.Size, fi.Mtime.UTC().Format(time.RFC3339), fi.Hash, fi.Key)
+        }
+    }
 
-        // decode the packet
-        datain := Decode(bytes.NewBuffer(buffer[0:received_bytes]))
-        trace("[CLIENT (%s)] <message-in>:%s\n", s_tag, datain.String())
+    file = create_file(buf.Bytes())
+    file.mtime = time.Now()
+    return file
+}
 
-        // collect the data
-        if datain.opcode == 3 {
-            trace("[CLIENT (%s)] %s\n", s_tag, "GOT DATA!!")
+// ---------------------------------
+// Utilities
+// ---------------------------------
+func chk_err(err error) {
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        os.Exit(1)
+    }
+}
 
-            if datain.block != transfer_state.last_block_received + 1 {
-                trace("[CLIENT (%s)] Block Sequence Error, Actual=%d, Expected=%d, Message=%s\n", s_tag, datain.block, transfer_state.last_block_received + 1, datain.String())
+// The session TID is a fresh socket on a port picked by the kernel, which is
+// randomized and never collides with another live session
+func open_session_conn() (net.PacketConn, error) {
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+    if err != nil {
+        return nil, err
+    }
+    return impair_conn(conn, get_server_impairment()), nil
+}
 
-                // send ack
-                er := new(Message)
-                er.opcode = 5
-                er.errmsg = "Invalid Block Sequence"
-                encoded_er := Encode(er)
-                n, err := session_src_conn.WriteToUDP(encoded_er.Bytes(), serveraddr) 
-                chk_err(err)
-                trace("[%s] <send> : message-out=%s, bytes=%d, src=%s, dst=%s\n", "WRQ", er.String(), n, session_src_addr.String(), serveraddr.String());
+func get_session_tag(src_addr *net.UDPAddr, dst_addr *net.UDPAddr) (tag string) {
+    buf := new(bytes.Buffer)
+    buf.WriteString(strconv.Itoa(src_addr.Port))
+    buf.WriteString(":")
+    buf.WriteString(strconv.Itoa(dst_addr.Port))
+    return buf.String()
+}
 
-                trace("[CLIENT (%s)] Terminating RRQ Request Session", s_tag)
-                break;
-            }
 
-            // append/store data in temp buffer
-            transfer_state.buf.Write(datain.payload[:])
-            transfer_state.last_block_received = datain.block
-            datain_bytes += datain.sz
-
-            // send ack
-            ack := new(Message)
-            ack.opcode = 4
-            ack.block = datain.block
-            encoded_ack := Encode(ack)
-            n, err := session_src_conn.WriteToUDP(encoded_ack.Bytes(), serveraddr) 
-            chk_err(err)
-            trace("[CLIENT (%s)] <send> : message-out=%s, bytes=%d, src=%s, dst=%s\n", s_tag, ack.String(), n, session_src_addr.String(), serveraddr.String());
-
-            // If EOF, complete the file storage transaction
-            if received_bytes < ( chunk_sz + tftp_data_header_bytes ) {
-                completed = true
-                break
-            }
-        } else {
-            trace("[CLIENT (%s)] %s\n", s_tag, "Invalid Request For Control Loop")
-        }
+// ---------------------------------
+// Test Clients For Read/Write
+// ---------------------------------
+func write_file(server string, key string, payload_sz int) (string, bool) {
+    content := generate_random_bytes(payload_sz)
+    c, err := new_client(server)
+    chk_err(err)
+    if _, err := c.Put(context.Background(), key, bytes.NewReader(content)); err != nil {
+        client_log.warnf("WRQ failed, Key=%s : %s", key, err.Error())
+        return "", false
     }
+    return compute_sha1(content), true
+}
 
-    if completed == true {
-        // store the file
-        trace("[CLIENT (%s)] data receieved fully for Key=%s, bytes=%s\n", s_tag, key, datain_bytes)
-        hash := compute_sha1(transfer_state.buf.Bytes()[0:datain_bytes])
-        trace("[CLIENT (%s)] RRQ RECIEVE COMPLETED, File=%s\n", s_tag, key)
-
-        return hash, true
-    } else {
+func read_file(server string, key string) (hash string, ok bool) {
+    c, err := new_client(server)
+    chk_err(err)
+    h := sha1.New()
+    if _, err := c.Get(context.Background(), key, h); err != nil {
+        client_log.warnf("RRQ failed, Key=%s : %s", key, err.Error())
         return "", false
     }
+    return fmt.Sprintf("%x", h.Sum(nil)), true
 }
 
 func testCodec() {
     // encode
-    msg := new(Message)
-    msg.opcode = 3
-    msg.block = 213
+    msg := new(tftp.Message)
+    msg.Opcode = 3
+    msg.Block = 213
     payload :=  "asdfaksdjflkasjdfjaslkdfjlaksdaadsfa"
-    copy(msg.payload[:], payload)
-    msg.sz = len(payload)
-    encoded := Encode(msg)
+    msg.Payload = []byte(payload)
+    msg.Sz = len(payload)
+    encoded := tftp.Encode(msg)
     fmt.Println(encoded.Bytes())
 
     // decode
-    decoded := Decode(encoded)
+    decoded, err := tftp.Decode(encoded)
+    chk_err(err)
     fmt.Println(decoded.String())
 }
 
 // ---------------------------------
 // Test Utilities
 // ---------------------------------
-func test_rw(key string, payload_sz int, read_times int) {
+var tester_log = new_logger("TESTER")
+
+// Runs the sample transfers against server, returns the exit status : 0
+// when every read matched what was written, 1 otherwise
+func run_self_test(server string) (int) {
+    // < TESTING MESSAGES >
+    tests := []struct{ key string; sz int; reads int }{
+        { "key_511", 511, 10 },
+        { "key_512", 512, 10 },
+        { "key_513", 513, 10 },
+        { "key_99845", 99845, 2 },
+    }
+    // < TESTING MESSAGES >
+
+    var wg sync.WaitGroup
+    failed := false
+    var mu sync.Mutex
+    for _, t := range tests {
+        wg.Add(1)
+        go func(key string, sz int, reads int) {
+            defer wg.Done()
+            if test_rw(server, key, sz, reads) == false {
+                mu.Lock()
+                failed = true
+                mu.Unlock()
+            }
+        }(t.key, t.sz, t.reads)
+    }
+    wg.Wait()
+    if failed == true {
+        tester_log.errorf("FAILED")
+        return 1
+    }
+    tester_log.infof("PASSED")
+    return 0
+}
+
+func test_rw(server string, key string, payload_sz int, read_times int) (ok bool) {
 
-    w_hash, _ := write_file(key, payload_sz)
+    w_hash, ok := write_file(server, key, payload_sz)
+    if ok == false {
+        tester_log.errorf("[FAIL] write failed, Key=%s", key)
+        return false
+    }
 
     for i := 0; i < read_times; i++ {
-        r_hash, _ := read_file(key)
-        match := strings.EqualFold(w_hash, r_hash)
+        r_hash, read_ok := read_file(server, key)
+        match := read_ok == true && strings.EqualFold(w_hash, r_hash)
         if match {
-            trace("[TESTER] [OK] write_hash=[%s], read_hash=[%s]\n", w_hash, r_hash)
+            tester_log.infof("[OK] write_hash=[%s], read_hash=[%s]", w_hash, r_hash)
         } else {
-            trace("[TESTER] [FAIL] write_hash=[%s], read_hash=[%s]\n", w_hash, r_hash)
+            tester_log.errorf("[FAIL] write_hash=[%s], read_hash=[%s]", w_hash, r_hash)
+            ok = false
         }
     }
+    return ok
 }
 
 func generate_random_bytes(sz int) (buf []byte) {
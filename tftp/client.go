@@ -0,0 +1,733 @@
+package tftp
+
+import(
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// ---------------------------------
+// TFTP Client
+// ---------------------------------
+// A client for RRQ/WRQ transfers against any TFTP server, used by the client
+// commands of ttftp and its tests. Options are only sent when they differ
+// from the RFC 1350 defaults, except tsize which every RRQ asks for so
+// servers which require a handshake ( ttftp -rrq-handshake-size ) answer.
+// The first packet of the server fixes its TID, packets from anyone else get
+// an ERROR back and are ignored. The last packets sent are retransmitted
+// every Timeout until the server answers, up to Retries times in a row.
+//
+// Errors : a *ServerError when the server aborts with an ERROR, ErrTimeout
+// ( wrapped ) when it stops answering and the context's error when the
+// context is done, in which case the server is sent an ERROR. With Trace
+// set every packet sent and received is printed to it, with Logf set the
+// client logs what it does ( see LogError ) and with Wrap the socket of every
+// transfer goes through it, e.g. to simulate a bad network
+type Client struct {
+    Addr *net.UDPAddr
+    Mode string
+    Blksize int
+    Windowsize int
+    Timeout time.Duration
+    SendTimeout bool
+    Retries int
+    Trace io.Writer
+    Logf func(level int, format string, v ...interface{})
+    Wrap func(conn net.PacketConn) net.PacketConn
+    retransmits int64
+}
+
+// The levels Client.Logf gets, from the most to the least severe. Packet
+// lines pass the packet read as a []byte argument
+const(
+    LogError int = iota
+    LogWarn
+    LogInfo
+    LogDebug
+    LogPacket
+)
+
+// An ERROR sent by the server
+type ServerError struct {
+    Code uint16
+    Msg string
+}
+
+func (err *ServerError) Error() (string) {
+    return fmt.Sprintf("server error : Code=%d Msg=%s", err.Code, err.Msg)
+}
+
+var ErrTimeout = errors.New("timed out")
+
+// The content transferred does not have the SHA-256 expected
+var ErrHashMismatch = errors.New("hash mismatch")
+
+// Packets retransmitted by the transfers of c so far
+func (c *Client) Retransmits() (int64) {
+    return atomic.LoadInt64(&c.retransmits)
+}
+
+// Returns a client with the RFC 1350 defaults for server, host[:port] where
+// the port defaults to 69
+func NewClient(server string) (c *Client, err error) {
+    if _, _, err := net.SplitHostPort(server); err != nil {
+        server = net.JoinHostPort(server, "69")
+    }
+    addr, err := net.ResolveUDPAddr("udp", server)
+    if err != nil {
+        return nil, err
+    }
+    c = new(Client)
+    c.Addr = addr
+    c.Mode = "octet"
+    c.Blksize = BlockSize
+    c.Windowsize = 1
+    c.Timeout = time.Second
+    c.Retries = 5
+    return c, nil
+}
+
+func (c *Client) logf(level int, format string, v ...interface{}) {
+    if c.Logf != nil {
+        c.Logf(level, format, v...)
+    }
+}
+
+// One transfer : its socket, the server TID once known and what to
+// retransmit on timeouts
+type client_transfer struct {
+    sync.Mutex
+    c *Client
+    ctx context.Context
+    done chan struct{}
+    conn net.PacketConn
+    local *net.UDPAddr
+    peer *net.UDPAddr
+    last [][]byte
+    last_desc []string
+    buffer []byte
+    tid string
+}
+
+func (c *Client) open(ctx context.Context) (t *client_transfer, err error) {
+    udpconn, err := net.ListenUDP("udp", nil)
+    if err != nil {
+        return nil, err
+    }
+    var conn net.PacketConn = udpconn
+    if c.Wrap != nil {
+        conn = c.Wrap(conn)
+    }
+    t = new(client_transfer)
+    t.c = c
+    t.ctx = ctx
+    t.done = make(chan struct{})
+    t.conn = conn
+    t.local = conn.LocalAddr().(*net.UDPAddr)
+    t.buffer = make([]byte, DataHeaderBytes + BlockSize + 1)
+
+    // a done context wakes up the pending read, the lock makes sure receive
+    // does not push the deadline out again once the context is done
+    go func() {
+        select {
+        case <-ctx.Done():
+            t.Lock()
+            conn.SetReadDeadline(time.Unix(1, 0))
+            t.Unlock()
+        case <-t.done:
+        }
+    }()
+    return t, nil
+}
+
+// Logs with the TID of the session once known
+func (t *client_transfer) logf(level int, format string, v ...interface{}) {
+    if t.tid != "" {
+        format += ", tid=" + t.tid
+    }
+    t.c.logf(level, format, v...)
+}
+
+func (t *client_transfer) close() {
+    close(t.done)
+    t.conn.Close()
+}
+
+func (t *client_transfer) send(window ...*Message) (error) {
+    t.last = t.last[0:0]
+    t.last_desc = t.last_desc[0:0]
+    for _, m := range window {
+        t.last = append(t.last, Encode(m).Bytes())
+        t.last_desc = append(t.last_desc, m.String())
+    }
+    return t.resend()
+}
+
+func (t *client_transfer) resend() (error) {
+    dst := t.peer
+    if dst == nil {
+        dst = t.c.Addr
+    }
+    for i, packet := range t.last {
+        n, err := t.conn.WriteTo(packet, dst)
+        if err != nil {
+            return err
+        }
+        t.trace("sent", t.last_desc[i])
+        t.logf(LogDebug, "<send> : bytes=%d, src=%s, dst=%s", n, t.local.String(), dst.String())
+    }
+    return nil
+}
+
+func (t *client_transfer) send_error(code uint16, msg string) {
+    if t.peer != nil {
+        er := NewError(code, msg)
+        t.conn.WriteTo(Encode(er).Bytes(), t.peer)
+        t.trace("sent", er.String())
+    }
+}
+
+func (t *client_transfer) trace(what string, desc string) {
+    if t.c.Trace != nil {
+        fmt.Fprintf(t.c.Trace, "%s %s\n", what, desc)
+    }
+}
+
+// Blocks of up to blksize bytes must fit in the read buffer, with a spare
+// byte to tell larger ones apart. An OACK must fit as well, whatever the
+// block size
+func (t *client_transfer) set_blksize(blksize int) {
+    if blksize < BlockSize {
+        blksize = BlockSize
+    }
+    t.buffer = make([]byte, DataHeaderBytes + blksize + 1)
+}
+
+// Waits for the next packet of the server that accept returns true for,
+// retransmitting on timeouts, which packets ignored do not put off. An ERROR
+// from the server is returned as a *ServerError
+func (t *client_transfer) receive(accept func(m *Message) bool) (m *Message, err error) {
+    timeouts := 0
+    deadline := time.Now().Add(t.c.Timeout)
+    for {
+        t.Lock()
+        if err := t.ctx.Err(); err != nil {
+            t.Unlock()
+            t.send_error(NotDefined, "Transfer cancelled")
+            return nil, err
+        }
+        t.conn.SetReadDeadline(deadline)
+        t.Unlock()
+
+        n, addr, err := t.conn.ReadFrom(t.buffer)
+        if err != nil {
+            if ne, ok := err.(net.Error); ok == false || ne.Timeout() == false {
+                return nil, err
+            }
+            if t.ctx.Err() != nil {
+                continue
+            }
+            timeouts++
+            if timeouts > t.c.Retries {
+                return nil, fmt.Errorf("%w waiting for %s", ErrTimeout, t.c.Addr.String())
+            }
+            t.logf(LogInfo, "Timeout, retransmitting ( %d / %d )", timeouts, t.c.Retries)
+            atomic.AddInt64(&t.c.retransmits, int64(len(t.last)))
+            if err := t.resend(); err != nil {
+                return nil, err
+            }
+            deadline = time.Now().Add(t.c.Timeout)
+            continue
+        }
+        src := addr.(*net.UDPAddr)
+        t.logf(LogPacket, "<read> : data=%s, bytes=%d, src=%s", t.buffer[0:n], n, src.String())
+
+        if t.peer == nil && src.IP.Equal(t.c.Addr.IP) == true {
+            // the first answer comes from the TID of the session
+            t.peer = src
+            t.tid = fmt.Sprintf("%d:%d", t.local.Port, src.Port)
+        }
+        if t.peer == nil || src.Port != t.peer.Port || src.IP.Equal(t.peer.IP) == false {
+            t.logf(LogWarn, "Ignoring packet from unknown TID, src=%s", src.String())
+            t.conn.WriteTo(Encode(NewError(UnknownTID, "Unknown transfer ID")).Bytes(), src)
+            continue
+        }
+
+        m, err := Decode(bytes.NewBuffer(t.buffer[0:n]))
+        if err != nil {
+            t.logf(LogWarn, "%s, src=%s", err.Error(), src.String())
+            continue
+        }
+        t.logf(LogDebug, "<message-in>:%s", m.String())
+        t.trace("received", m.String())
+        if m.Opcode == 5 {
+            return nil, &ServerError{ Code : m.ErrCode, Msg : m.ErrMsg }
+        }
+        if accept(m) {
+            return m, nil
+        }
+        t.logf(LogDebug, "Ignoring unexpected %s", m.String())
+    }
+}
+
+// Builds a request, tsize >= 0 is sent as the tsize option
+func (c *Client) request(opcode uint16, remote string, tsize int64) (m *Message) {
+    m = new(Message)
+    m.Opcode = opcode
+    m.Key = remote
+    m.Mode = c.Mode
+    m.Options = make(map[string]string)
+    if c.Blksize != BlockSize {
+        m.Options["blksize"] = strconv.Itoa(c.Blksize)
+    }
+    if c.Windowsize != 1 {
+        m.Options["windowsize"] = strconv.Itoa(c.Windowsize)
+    }
+    if c.SendTimeout == true {
+        secs := int(c.Timeout / time.Second)
+        if secs < 1 {
+            secs = 1
+        }
+        m.Options["timeout"] = strconv.Itoa(secs)
+    }
+    if tsize >= 0 {
+        m.Options["tsize"] = strconv.FormatInt(tsize, 10)
+    }
+    return m
+}
+
+// Checks the OACK of the server against what was asked for, a server may
+// lower blksize and windowsize but never raise them nor add options
+func (c *Client) accept_oack(req *Message, oack *Message) (blksize int, windowsize int, err error) {
+    blksize, windowsize = BlockSize, 1
+    for name, value := range oack.Options {
+        asked, ok := req.Options[name]
+        if ok == false {
+            return 0, 0, fmt.Errorf("server acknowledged option %s which was not requested", name)
+        }
+        if name == "blksize" || name == "windowsize" {
+            n, err := strconv.Atoi(value)
+            max, _ := strconv.Atoi(asked)
+            if err != nil || n < 1 || n > max {
+                return 0, 0, fmt.Errorf("server acknowledged bad %s %q", name, value)
+            }
+            if name == "blksize" {
+                blksize = n
+            } else {
+                windowsize = n
+            }
+        }
+    }
+    return blksize, windowsize, nil
+}
+
+// Reads remote into w, returns the number of bytes written
+func (c *Client) Get(ctx context.Context, remote string, w io.Writer) (n int64, err error) {
+    return c.get(ctx, remote, w, nil, nil)
+}
+
+// Resumes the download of remote into f, which holds what an earlier
+// transfer received. The server is asked to start past it with the offset
+// option and for the SHA-256 of the file. Servers without the offset option
+// send the whole file again, f is truncated then. The assembled file is
+// checked against the SHA-256 when the server gave one, ErrHashMismatch
+// ( wrapped ) otherwise. Returns the size of f
+func (c *Client) Resume(ctx context.Context, remote string, f *os.File) (n int64, err error) {
+    if c.Mode != "octet" {
+        return 0, fmt.Errorf("resuming needs the octet mode")
+    }
+    if _, err := f.Seek(0, io.SeekStart); err != nil {
+        return 0, err
+    }
+    h := sha256.New()
+    have, err := io.Copy(h, f)
+    if err != nil {
+        return 0, err
+    }
+
+    expected := ""
+    options := map[string]string{ "offset" : strconv.FormatInt(have, 10), "sha256" : "0" }
+    n, err = c.get(ctx, remote, io.MultiWriter(f, h), options, func(accepted map[string]string) error {
+        expected = accepted["sha256"]
+        if accepted["offset"] == options["offset"] {
+            if have > 0 {
+                c.logf(LogInfo, "Resuming at offset %d, Key=%s", have, remote)
+            }
+            return nil
+        }
+        have = 0
+        h.Reset()
+        if err := f.Truncate(0); err != nil {
+            return err
+        }
+        _, err := f.Seek(0, io.SeekStart)
+        return err
+    })
+    n += have
+    if err != nil {
+        return n, err
+    }
+    if sum := hex.EncodeToString(h.Sum(nil)); expected != "" && sum != expected {
+        return n, fmt.Errorf("%w : expected %s, got %s", ErrHashMismatch, expected, sum)
+    }
+    return n, nil
+}
+
+// Reads remote into w asking for the extra options, options_acked gets the
+// options the server acknowledged, none when it did not answer with an OACK,
+// before any DATA is written
+func (c *Client) get(ctx context.Context, remote string, w io.Writer, extra map[string]string, options_acked func(map[string]string) error) (n int64, err error) {
+    t, err := c.open(ctx)
+    if err != nil {
+        return 0, err
+    }
+    defer t.close()
+    if c.Mode == "netascii" {
+        nw := new_netascii_writer(w)
+        defer nw.flush()
+        w = nw
+    }
+
+    req := c.request(2, remote, 0)
+    for name, value := range extra {
+        req.Options[name] = value
+    }
+    t.set_blksize(c.Blksize)
+    if err := t.send(req); err != nil {
+        return 0, err
+    }
+    t.logf(LogDebug, "<send> : message-out=%s, dst=%s", req.String(), c.Addr.String())
+
+    blksize, windowsize := BlockSize, 1
+    var expected uint16 = 1
+    in_window := 0
+    nacked := false
+    var nacked_at uint16
+    first := true
+    for {
+        m, err := t.receive(func(m *Message) bool { return m.Opcode == 3 || m.Opcode == 6 && first == true })
+        if err != nil {
+            return n, err
+        }
+        if m.Opcode == 6 {
+            first = false
+            blksize, windowsize, err = c.accept_oack(req, m)
+            if err != nil {
+                t.send_error(BadOptions, err.Error())
+                return n, err
+            }
+            if options_acked != nil {
+                if err := options_acked(m.Options); err != nil {
+                    t.send_error(NotDefined, "Unable to write the file")
+                    return n, err
+                }
+            }
+            t.set_blksize(blksize)
+            SizeReadBuffer(t.conn, blksize, windowsize)
+            if err := t.send(NewAck(0)); err != nil {
+                return n, err
+            }
+            continue
+        }
+        if first == true && options_acked != nil {
+            if err := options_acked(map[string]string{}); err != nil {
+                t.send_error(NotDefined, "Unable to write the file")
+                return n, err
+            }
+        }
+        first = false
+
+        if m.Sz > blksize {
+            t.send_error(IllegalOp, "DATA larger than the block size")
+            return n, fmt.Errorf("server sent %d bytes in a block of %d", m.Sz, blksize)
+        }
+        if m.Block != expected {
+            if nacked == false || BlockAfter(m.Block, nacked_at) == false {
+                // ask for everything past the last block in sequence again,
+                // once per window the server sends
+                nacked = true
+                nacked_at = m.Block
+                in_window = 0
+                if err := t.send(NewAck(expected - 1)); err != nil {
+                    return n, err
+                }
+            }
+            continue
+        }
+        nacked = false
+
+        if _, err := w.Write(m.Payload[0:m.Sz]); err != nil {
+            t.send_error(DiskFull, "Unable to write the file")
+            return n, err
+        }
+        n += int64(m.Sz)
+        expected++
+        in_window++
+
+        eof := m.Sz < blksize
+        if eof == true || in_window == windowsize {
+            in_window = 0
+            if err := t.send(NewAck(m.Block)); err != nil {
+                return n, err
+            }
+        }
+        if eof == true {
+            t.logf(LogDebug, "COMPLETED : received last block, Key=%s, Size=%d", remote, n)
+            return n, nil
+        }
+    }
+}
+
+// Writes everything read from r to remote, returns the number of bytes sent.
+// The size is sent as tsize when r is a regular file or has a Len()
+func (c *Client) Put(ctx context.Context, remote string, r io.Reader) (n int64, err error) {
+    return c.put(ctx, remote, r, nil, nil)
+}
+
+// Writes r to remote as an upload the server may keep when it fails, under
+// token ( non-standard token option ). Running it again with the same token
+// goes on from the offset the server kept, r is positioned there. token
+// must name one upload of one content, servers without the option take the
+// whole of r again. Returns the size of r
+func (c *Client) ResumePut(ctx context.Context, remote string, r io.ReadSeeker, token string) (n int64, err error) {
+    if c.Mode != "octet" {
+        return 0, fmt.Errorf("resuming needs the octet mode")
+    }
+    if _, err := r.Seek(0, io.SeekStart); err != nil {
+        return 0, err
+    }
+    var off int64
+    options := map[string]string{ "token" : token, "offset" : "0" }
+    n, err = c.put(ctx, remote, r, options, func(accepted map[string]string) error {
+        if accepted["token"] != token {
+            return nil
+        }
+        kept, err := strconv.ParseInt(accepted["offset"], 10, 64)
+        if err != nil || kept < 0 {
+            return fmt.Errorf("server acknowledged bad offset %q", accepted["offset"])
+        }
+        if kept > 0 {
+            c.logf(LogInfo, "Resuming at offset %d, Key=%s", kept, remote)
+        }
+        off = kept
+        _, err = r.Seek(off, io.SeekStart)
+        return err
+    })
+    return off + n, err
+}
+
+// Writes r to remote asking for the extra options, options_acked gets the
+// options the server acknowledged, none when it answered with an ACK, before
+// any DATA is read from r
+func (c *Client) put(ctx context.Context, remote string, r io.Reader, extra map[string]string, options_acked func(map[string]string) error) (n int64, err error) {
+    size := reader_size(r)
+    t, err := c.open(ctx)
+    if err != nil {
+        return 0, err
+    }
+    defer t.close()
+    if c.Mode == "netascii" {
+        r = new_netascii_reader(r)
+        size = -1
+    }
+
+    req := c.request(1, remote, size)
+    for name, value := range extra {
+        req.Options[name] = value
+    }
+    if err := t.send(req); err != nil {
+        return 0, err
+    }
+    t.logf(LogDebug, "<send> : message-out=%s, dst=%s", req.String(), c.Addr.String())
+
+    m, err := t.receive(func(m *Message) bool { return m.Opcode == 6 || m.Opcode == 4 && m.Block == 0 })
+    if err != nil {
+        return 0, err
+    }
+    blksize, windowsize := BlockSize, 1
+    accepted := map[string]string{}
+    if m.Opcode == 6 {
+        blksize, windowsize, err = c.accept_oack(req, m)
+        if err != nil {
+            t.send_error(BadOptions, err.Error())
+            return 0, err
+        }
+        accepted = m.Options
+    }
+    if options_acked != nil {
+        if err := options_acked(accepted); err != nil {
+            t.send_error(BadOptions, err.Error())
+            return 0, err
+        }
+    }
+
+    // the window holds blocks sent but not acked yet, it slides past the
+    // blocks the server acks and is topped up from r
+    var window []*Message
+    var base uint16 = 1
+    eof := false
+    for {
+        for eof == false && len(window) < windowsize {
+            dataout := new(Message)
+            dataout.Opcode = 3
+            dataout.Block = base + uint16(len(window))
+            dataout.Payload = make([]byte, blksize)
+            k, err := io.ReadFull(r, dataout.Payload)
+            if err == io.EOF || err == io.ErrUnexpectedEOF {
+                eof = true
+            } else if err != nil {
+                t.send_error(NotDefined, "Unable to read the file")
+                return n, err
+            }
+            dataout.Sz = k
+            window = append(window, dataout)
+        }
+
+        if err := t.send(window...); err != nil {
+            return n, err
+        }
+        // an ACK of the block before the window says its first block was
+        // lost ( RFC 7440 ), the window goes again at once, once per window
+        var ack *Message
+        resent := false
+        for {
+            ack, err = t.receive(func(m *Message) bool {
+                return m.Opcode == 4 && int(m.Block - (base - 1)) <= len(window)
+            })
+            if err != nil {
+                return n, err
+            }
+            if ack.Block != base - 1 {
+                break
+            }
+            if resent == false {
+                resent = true
+                t.logf(LogInfo, "Block=%d was lost, sending the window again", base)
+                atomic.AddInt64(&t.c.retransmits, int64(len(t.last)))
+                if err := t.resend(); err != nil {
+                    return n, err
+                }
+            }
+        }
+
+        acked := int(ack.Block - base) + 1
+        for _, dataout := range window[0:acked] {
+            n += int64(dataout.Sz)
+        }
+        last := window[acked - 1]
+        window = window[acked:]
+        base += uint16(acked)
+        if last.Sz < blksize {
+            t.logf(LogDebug, "COMPLETED : received last ack, Key=%s, Size=%d", remote, n)
+            return n, nil
+        }
+    }
+}
+
+// Bytes left to read from r, -1 when unknown
+func reader_size(r io.Reader) (int64) {
+    if f, ok := r.(*os.File); ok == true {
+        fi, err := f.Stat()
+        if err != nil || fi.Mode().IsRegular() == false {
+            return -1
+        }
+        off, err := f.Seek(0, io.SeekCurrent)
+        if err != nil {
+            return -1
+        }
+        return fi.Size() - off
+    }
+    if l, ok := r.(interface{ Len() int }); ok == true {
+        return int64(l.Len())
+    }
+    return -1
+}
+
+// ---------------------------------
+// Netascii ( RFC 764 )
+// ---------------------------------
+// Lines end with CR LF on the wire and a bare CR is sent as CR NUL, locally
+// lines end with LF
+type netascii_reader struct {
+    r io.Reader
+    pending []byte
+    buf []byte
+}
+
+func new_netascii_reader(r io.Reader) (*netascii_reader) {
+    return &netascii_reader{ r : r, buf : make([]byte, 4096) }
+}
+
+func (nr *netascii_reader) Read(p []byte) (int, error) {
+    for len(nr.pending) == 0 {
+        k, err := nr.r.Read(nr.buf)
+        for _, b := range nr.buf[0:k] {
+            if b == '\n' {
+                nr.pending = append(nr.pending, '\r', '\n')
+            } else if b == '\r' {
+                nr.pending = append(nr.pending, '\r', 0)
+            } else {
+                nr.pending = append(nr.pending, b)
+            }
+        }
+        if len(nr.pending) == 0 && err != nil {
+            return 0, err
+        }
+    }
+    k := copy(p, nr.pending)
+    nr.pending = nr.pending[k:]
+    return k, nil
+}
+
+type netascii_writer struct {
+    w io.Writer
+    cr bool
+}
+
+func new_netascii_writer(w io.Writer) (*netascii_writer) {
+    return &netascii_writer{ w : w }
+}
+
+func (nw *netascii_writer) Write(p []byte) (int, error) {
+    out := make([]byte, 0, len(p) + 1)
+    for _, b := range p {
+        if nw.cr == true {
+            nw.cr = false
+            if b == '\n' {
+                out = append(out, '\n')
+                continue
+            }
+            out = append(out, '\r')
+            if b == 0 {
+                continue
+            }
+        }
+        if b == '\r' {
+            nw.cr = true
+            continue
+        }
+        out = append(out, b)
+    }
+    if _, err := nw.w.Write(out); err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
+
+// A CR at the very end has nothing to pair with, it is kept as is
+func (nw *netascii_writer) flush() {
+    if nw.cr == true {
+        nw.cr = false
+        nw.w.Write([]byte{ '\r' })
+    }
+}
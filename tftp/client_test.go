@@ -0,0 +1,84 @@
+package tftp
+
+import(
+    "bytes"
+    "context"
+    "net"
+    "testing"
+    "time"
+)
+
+// A server answering from its own TID, whose packets are read through a
+// helper failing the test on timeouts
+type fake_server struct {
+    t *testing.T
+    conn *net.UDPConn
+    buffer []byte
+}
+
+func new_fake_server(t *testing.T) (s *fake_server) {
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{ IP : net.IPv4(127, 0, 0, 1) })
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    return &fake_server{ t : t, conn : conn, buffer : make([]byte, 1024) }
+}
+
+func (s *fake_server) read(timeout time.Duration) (*Message, *net.UDPAddr) {
+    s.conn.SetReadDeadline(time.Now().Add(timeout))
+    n, src, err := s.conn.ReadFromUDP(s.buffer)
+    if err != nil {
+        s.t.Fatalf("reading : %s", err.Error())
+    }
+    m, err := Decode(bytes.NewBuffer(s.buffer[0:n]))
+    if err != nil {
+        s.t.Fatal(err)
+    }
+    return m, src
+}
+
+func (s *fake_server) send(m *Message, dst *net.UDPAddr) {
+    if _, err := s.conn.WriteTo(Encode(m).Bytes(), dst); err != nil {
+        s.t.Fatal(err)
+    }
+}
+
+// An ACK of the block before a window means its first block was lost, the
+// client sends the window again without waiting for a timeout
+func TestPutWindowFirstBlockLost(t *testing.T) {
+    s := new_fake_server(t)
+    c, err := NewClient(s.conn.LocalAddr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    c.Blksize, c.Windowsize, c.Timeout = 8, 4, 5 * time.Second
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    done := make(chan error, 1)
+    go func() {
+        _, err := c.Put(ctx, "f", bytes.NewReader(make([]byte, 100)))
+        done <- err
+    }()
+
+    req, peer := s.read(time.Second)
+    if req.Opcode != 1 {
+        t.Fatalf("got %s, want a WRQ", req.String())
+    }
+    s.send(&Message{ Opcode : 6, Options : map[string]string{ "blksize" : "8", "windowsize" : "4" } }, peer)
+    for i := 1; i <= 4; i++ {
+        if m, _ := s.read(time.Second); m.Opcode != 3 || m.Block != uint16(i) {
+            t.Fatalf("got %s, want DATA block %d", m.String(), i)
+        }
+    }
+    s.send(NewAck(0), peer)
+    if m, _ := s.read(time.Second); m.Opcode != 3 || m.Block != 1 {
+        t.Fatalf("got %s, want DATA block 1 again", m.String())
+    }
+    if c.Retransmits() != 4 {
+        t.Errorf("got %d retransmits, want 4", c.Retransmits())
+    }
+    cancel()
+    <-done
+}
@@ -0,0 +1,123 @@
+package tftp
+
+import(
+    "bytes"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+    tests := []struct {
+        name string
+        m Message
+    }{
+        { "rrq", Message{ Opcode : 2, Key : "images/boot.img", Mode : "octet" } },
+        { "wrq netascii", Message{ Opcode : 1, Key : "cfg", Mode : "netascii" } },
+        { "rrq options", Message{ Opcode : 2, Key : "a", Mode : "octet", Options : map[string]string{ "blksize" : "1428", "tsize" : "0", "windowsize" : "16" } } },
+        { "data empty", Message{ Opcode : 3, Block : 7, Payload : []byte{}, Sz : 0 } },
+        { "data full", Message{ Opcode : 3, Block : 65535, Payload : bytes.Repeat([]byte{ 0xa5 }, BlockSize), Sz : BlockSize } },
+        { "data max", Message{ Opcode : 3, Block : 1, Payload : bytes.Repeat([]byte{ 1 }, MaxBlksize), Sz : MaxBlksize } },
+        { "ack", Message{ Opcode : 4, Block : 0 } },
+        { "error", Message{ Opcode : 5, ErrCode : FileNotFound, ErrMsg : "File not found" } },
+        { "error empty", Message{ Opcode : 5, ErrCode : NotDefined } },
+        { "oack", Message{ Opcode : 6, Options : map[string]string{ "blksize" : "512" } } },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            decoded, err := Decode(Encode(&tt.m))
+            if err != nil {
+                t.Fatalf("Decode : %s", err.Error())
+            }
+            if reflect.DeepEqual(*decoded, tt.m) == false {
+                t.Errorf("round trip : got %+v, want %+v", *decoded, tt.m)
+            }
+        })
+    }
+}
+
+func TestEncodeWire(t *testing.T) {
+    tests := []struct {
+        name string
+        m Message
+        want []byte
+    }{
+        { "rrq default mode", Message{ Opcode : 2, Key : "f" }, []byte("\x00\x02f\x00octet\x00") },
+        { "options sorted", Message{ Opcode : 1, Key : "f", Mode : "octet", Options : map[string]string{ "tsize" : "3", "blksize" : "8" } },
+            []byte("\x00\x01f\x00octet\x00blksize\x008\x00tsize\x003\x00") },
+        { "data", Message{ Opcode : 3, Block : 0x0102, Payload : []byte("xyz"), Sz : 3 }, []byte("\x00\x03\x01\x02xyz") },
+        { "ack", Message{ Opcode : 4, Block : 0xfffe }, []byte("\x00\x04\xff\xfe") },
+        { "error", Message{ Opcode : 5, ErrCode : 2, ErrMsg : "no" }, []byte("\x00\x05\x00\x02no\x00") },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := Encode(&tt.m).Bytes(); bytes.Equal(got, tt.want) == false {
+                t.Errorf("got %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestDecodeMalformed(t *testing.T) {
+    tests := []struct {
+        name string
+        packet []byte
+        want string
+    }{
+        { "empty", []byte{}, "short opcode" },
+        { "one byte", []byte{ 0 }, "short opcode" },
+        { "unknown opcode", []byte{ 0, 9 }, "unknown opcode 9" },
+        { "opcode zero", []byte{ 0, 0 }, "unknown opcode 0" },
+        { "rrq no filename", []byte("\x00\x01"), "unterminated filename" },
+        { "rrq unterminated filename", []byte("\x00\x01file"), "unterminated filename" },
+        { "rrq no mode", []byte("\x00\x01file\x00"), "unterminated mode" },
+        { "rrq unterminated mode", []byte("\x00\x02file\x00octet"), "unterminated mode" },
+        { "option without value", []byte("\x00\x02f\x00octet\x00blksize\x00"), "unterminated option value" },
+        { "unterminated option", []byte("\x00\x02f\x00octet\x00blksize"), "unterminated option name" },
+        { "data short block", []byte{ 0, 3, 1 }, "short DATA block number" },
+        { "data too large", append([]byte{ 0, 3, 0, 1 }, make([]byte, MaxBlksize + 1)...), "DATA payload larger" },
+        { "ack short block", []byte{ 0, 4 }, "short ACK block number" },
+        { "error short code", []byte{ 0, 5, 0 }, "short ERROR code" },
+        { "oack unterminated", []byte("\x00\x06blksize\x00512"), "unterminated option value" },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            m, err := Decode(bytes.NewBuffer(tt.packet))
+            if err == nil {
+                t.Fatalf("decoded %s, want an error", m.String())
+            }
+            if strings.Contains(err.Error(), tt.want) == false {
+                t.Errorf("error %q does not mention %q", err.Error(), tt.want)
+            }
+        })
+    }
+}
+
+func TestDecodeLenient(t *testing.T) {
+    tests := []struct {
+        name string
+        packet []byte
+        want Message
+    }{
+        { "error without terminator", []byte("\x00\x05\x00\x01gone"), Message{ Opcode : 5, ErrCode : 1, ErrMsg : "gone" } },
+        { "option names lower-cased", []byte("\x00\x02f\x00OCTET\x00BlkSize\x001024\x00"),
+            Message{ Opcode : 2, Key : "f", Mode : "OCTET", Options : map[string]string{ "blksize" : "1024" } } },
+        { "data payload copied", []byte("\x00\x03\x00\x01ab"), Message{ Opcode : 3, Block : 1, Payload : []byte("ab"), Sz : 2 } },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            packet := append([]byte{}, tt.packet...)
+            m, err := Decode(bytes.NewBuffer(packet))
+            if err != nil {
+                t.Fatalf("Decode : %s", err.Error())
+            }
+            // the payload must not alias the receive buffer, which is reused
+            for i := range packet {
+                packet[i] = 0xff
+            }
+            if reflect.DeepEqual(*m, tt.want) == false {
+                t.Errorf("got %+v, want %+v", *m, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,92 @@
+package tftp
+
+import(
+    "bytes"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// go test -fuzz FuzzDecode ./tftp, and so on for each target. Without -fuzz
+// the seeds run as ordinary tests
+
+func FuzzDecode(f *testing.F) {
+    seeds := []Message{
+        { Opcode : 1, Key : "a/b", Mode : "octet" },
+        { Opcode : 2, Key : "f", Mode : "netascii", Options : map[string]string{ "blksize" : "1428", "tsize" : "0", "windowsize" : "16" } },
+        { Opcode : 3, Block : 1, Payload : []byte("data"), Sz : 4 },
+        { Opcode : 3, Block : 65535, Payload : []byte{}, Sz : 0 },
+        { Opcode : 4, Block : 7 },
+        { Opcode : 5, ErrCode : 1, ErrMsg : "File not found" },
+        { Opcode : 6, Options : map[string]string{ "offset" : "100", "sha256" : "0" } },
+    }
+    for _, m := range seeds {
+        f.Add(Encode(&m).Bytes())
+    }
+    f.Add([]byte{})
+    f.Add([]byte("\x00\x02f\x00OCTET\x00BlkSize\x00"))
+    f.Add([]byte("\x00\x05\x00\x01no terminator"))
+    f.Add([]byte("\x00\x09"))
+
+    f.Fuzz(func(t *testing.T, packet []byte) {
+        m, err := Decode(bytes.NewBuffer(append([]byte{}, packet...)))
+        if err != nil {
+            if m != nil {
+                t.Fatalf("Decode returned %s along with %s", m.String(), err.Error())
+            }
+            return
+        }
+        if m.Opcode < 1 || m.Opcode > 6 {
+            t.Fatalf("decoded unknown opcode %d", m.Opcode)
+        }
+        if m.Opcode == 3 && (m.Sz != len(m.Payload) || m.Sz > MaxBlksize || m.Sz > len(packet)) {
+            t.Fatalf("DATA of %d bytes with a payload of %d from a packet of %d", m.Sz, len(m.Payload), len(packet))
+        }
+        if strings.HasPrefix(m.String(), "[ ") == false {
+            t.Fatalf("message traced as %q", m.String())
+        }
+
+        // what decodes encodes back to the same message, the mode of a
+        // request defaults to octet
+        again, err := Decode(Encode(m))
+        if err != nil {
+            t.Fatalf("%s encoded does not decode : %s", m.String(), err.Error())
+        }
+        want := *m
+        if (m.Opcode == 1 || m.Opcode == 2) && m.Mode == "" {
+            want.Mode = "octet"
+        }
+        if reflect.DeepEqual(*again, want) == false {
+            t.Fatalf("round trip of %+v gave %+v", want, *again)
+        }
+    })
+}
+
+func FuzzReadOptions(f *testing.F) {
+    f.Add([]byte("blksize\x001428\x00tsize\x000\x00"))
+    f.Add([]byte("BLKSIZE\x008\x00blksize\x0016\x00"))
+    f.Add([]byte("\x00\x00"))
+    f.Add([]byte("name\x00unterminated"))
+
+    f.Fuzz(func(t *testing.T, data []byte) {
+        options, err := read_options(bytes.NewBuffer(append([]byte{}, data...)))
+        if err != nil {
+            return
+        }
+        // a name and a value take two terminators at least
+        if 2 * len(options) > bytes.Count(data, []byte{ 0 }) {
+            t.Fatalf("%d options out of %d terminators", len(options), bytes.Count(data, []byte{ 0 }))
+        }
+        for name, value := range options {
+            if name != strings.ToLower(name) || strings.IndexByte(name, 0) >= 0 || strings.IndexByte(value, 0) >= 0 {
+                t.Fatalf("option %q=%q", name, value)
+            }
+        }
+        buf := new(bytes.Buffer)
+        write_options(buf, options)
+        again, err := read_options(buf)
+        if err != nil || reflect.DeepEqual(again, options) == false {
+            t.Fatalf("options %v written and read back are %v ( %v )", options, again, err)
+        }
+    })
+}
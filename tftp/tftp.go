@@ -0,0 +1,288 @@
+// Package tftp is the protocol side of ttftp : the encoding of TFTP packets
+// ( RFC 1350 ) with options ( RFC 2347, 2348, 2349, 7440 ) and a client for
+// RRQ/WRQ transfers against any TFTP server, netascii included. The server
+// lives in the ttftp command, which uses this package for its packets
+package tftp
+
+import(
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// ---------------------------------
+// Constants
+// ---------------------------------
+const(
+    // DATA payload bytes without the blksize option
+    BlockSize int = 512
+    // largest blksize a peer may ask for ( RFC 2348 )
+    MaxBlksize int = 65464
+    DataHeaderBytes int = 4
+)
+
+// TFTP error codes ( RFC 1350 )
+const(
+    NotDefined uint16 = 0
+    FileNotFound uint16 = 1
+    AccessViolation uint16 = 2
+    DiskFull uint16 = 3
+    IllegalOp uint16 = 4
+    UnknownTID uint16 = 5
+    FileExists uint16 = 6
+    NoSuchUser uint16 = 7
+    BadOptions uint16 = 8
+)
+
+// ---------------------------------
+// TFTP Protocol Encoding/Decoding
+// ---------------------------------
+type Message struct {
+    Opcode uint16
+    Key string
+    Mode string
+    Options map[string]string
+    Payload []byte
+    Block uint16
+    ErrCode uint16
+    ErrMsg string
+    Sz int
+}
+
+func (m Message) String() (string) {
+    buf := new(bytes.Buffer)
+
+    buf.WriteString("[ ")
+    if m.Opcode == 1 {
+        buf.WriteString("<")
+        buf.WriteString("WRQ")
+        buf.WriteString(">")
+        buf.WriteString(" Key=")
+        buf.WriteString(m.Key)
+    } else if m.Opcode == 2 {
+        buf.WriteString("<")
+        buf.WriteString("RRQ")
+        buf.WriteString(">")
+        buf.WriteString(" ")
+        buf.WriteString(m.Key)
+    } else if m.Opcode == 3 {
+        buf.WriteString("<")
+        buf.WriteString("DATA")
+        buf.WriteString(">")
+        buf.WriteString(" Block=")
+        buf.WriteString(strconv.Itoa(int(m.Block)))
+        buf.WriteString(" PayloadSz=")
+        buf.WriteString(strconv.Itoa(int(m.Sz)))
+    } else if m.Opcode == 4 {
+        buf.WriteString("<")
+        buf.WriteString("ACK")
+        buf.WriteString(">")
+        buf.WriteString(" Block=")
+        buf.WriteString(strconv.Itoa(int(m.Block)))
+    } else if m.Opcode == 5 {
+        buf.WriteString("<")
+        buf.WriteString("ERR")
+        buf.WriteString(">")
+        buf.WriteString(" Code=")
+        buf.WriteString(strconv.Itoa(int(m.ErrCode)))
+        buf.WriteString(" Msg=")
+        buf.WriteString(m.ErrMsg)
+    } else if m.Opcode == 6 {
+        buf.WriteString("<")
+        buf.WriteString("OACK")
+        buf.WriteString(">")
+    } else {
+        // Ignore
+    }
+    for _, name := range option_names(m.Options) {
+        buf.WriteString(" ")
+        buf.WriteString(name)
+        buf.WriteString("=")
+        buf.WriteString(m.Options[name])
+    }
+    buf.WriteString(" ]")
+    return buf.String()
+}
+    
+// Reads a NUL terminated string, the terminator is consumed but not returned
+func read_cstring(buf *bytes.Buffer, what string) (string, error) {
+    str, err := buf.ReadString(byte(0))
+    if err != nil {
+        return "", fmt.Errorf("malformed packet : unterminated %s", what)
+    }
+    return str[0:len(str) - 1], nil
+}
+
+// Option names sorted, so options are always encoded and traced the same way
+func option_names(options map[string]string) (names []string) {
+    for name := range options {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// Reads the option name/value pairs ( RFC 2347 ) which follow a request or
+// make up an OACK. Names are case-insensitive and lower-cased here
+func read_options(buf *bytes.Buffer) (options map[string]string, err error) {
+    for buf.Len() > 0 {
+        name, err := read_cstring(buf, "option name")
+        if err != nil {
+            return nil, err
+        }
+        value, err := read_cstring(buf, "option value")
+        if err != nil {
+            return nil, err
+        }
+        if options == nil {
+            options = make(map[string]string)
+        }
+        options[strings.ToLower(name)] = value
+    }
+    return options, nil
+}
+
+func Decode(buf *bytes.Buffer) (m *Message, err error) {
+    m = new(Message)
+
+    var opcode uint16
+    err = binary.Read(buf, binary.BigEndian, &opcode);
+    if err != nil {
+        return nil, fmt.Errorf("malformed packet : short opcode")
+    }
+    m.Opcode = opcode
+    if opcode == 1 || opcode == 2 {
+        m.Key, err = read_cstring(buf, "filename")
+        if err != nil {
+            return nil, err
+        }
+        m.Mode, err = read_cstring(buf, "mode")
+        if err != nil {
+            return nil, err
+        }
+        m.Options, err = read_options(buf)
+        if err != nil {
+            return nil, err
+        }
+    } else if opcode == 3 {
+        err = binary.Read(buf, binary.BigEndian, &m.Block);
+        if err != nil {
+            return nil, fmt.Errorf("malformed packet : short DATA block number")
+        }
+        // DATA blocks are BlockSize bytes unless a larger blksize ( RFC 2348 )
+        // was negotiated, the session checks against its own
+        if buf.Len() > MaxBlksize {
+            return nil, fmt.Errorf("malformed packet : DATA payload larger than %d bytes", MaxBlksize)
+        }
+        m.Payload = make([]byte, buf.Len())
+        m.Sz, _ = buf.Read(m.Payload)
+    } else if opcode == 4 {
+        err = binary.Read(buf, binary.BigEndian, &m.Block);
+        if err != nil {
+            return nil, fmt.Errorf("malformed packet : short ACK block number")
+        }
+    } else if opcode == 5 {
+        err = binary.Read(buf, binary.BigEndian, &m.ErrCode);
+        if err != nil {
+            return nil, fmt.Errorf("malformed packet : short ERROR code")
+        }
+        // be lenient with peers which forget the terminator on errors
+        errmsg, _ := buf.ReadString(byte(0));
+        m.ErrMsg = strings.TrimRight(errmsg, "\x00")
+    } else if opcode == 6 {
+        m.Options, err = read_options(buf)
+        if err != nil {
+            return nil, err
+        }
+    } else {
+        return nil, fmt.Errorf("malformed packet : unknown opcode %d", opcode)
+    }
+
+    return m, nil
+}
+
+func Encode(m *Message) (buf *bytes.Buffer) {
+    buf = new(bytes.Buffer)
+
+    opcode := m.Opcode
+    binary.Write(buf, binary.BigEndian, uint16(m.Opcode))
+    if opcode == 1 || opcode == 2 {
+        mode := m.Mode
+        if mode == "" {
+            mode = "octet"
+        }
+        buf.WriteString(m.Key)
+        buf.WriteByte(0)
+        buf.WriteString(mode)
+        buf.WriteByte(0)
+        write_options(buf, m.Options)
+    } else if opcode == 3 {
+        // writes to a bytes.Buffer do not fail
+        binary.Write(buf, binary.BigEndian, uint16(m.Block))
+        buf.Write(m.Payload[0:m.Sz])
+    } else if opcode == 4 {
+        binary.Write(buf, binary.BigEndian, uint16(m.Block))
+    } else if opcode == 5 {
+        binary.Write(buf, binary.BigEndian, uint16(m.ErrCode))
+        buf.WriteString(m.ErrMsg)
+        buf.WriteByte(0)
+    } else if opcode == 6 {
+        write_options(buf, m.Options)
+    }
+
+    return buf
+}
+
+func write_options(buf *bytes.Buffer, options map[string]string) {
+    for _, name := range option_names(options) {
+        buf.WriteString(name)
+        buf.WriteByte(0)
+        buf.WriteString(options[name])
+        buf.WriteByte(0)
+    }
+}
+
+func NewError(code uint16, msg string) (m *Message) {
+    m = new(Message)
+    m.Opcode = 5
+    m.ErrCode = code
+    m.ErrMsg = msg
+    return m
+}
+
+func NewAck(block uint16) (m *Message) {
+    m = new(Message)
+    m.Opcode = 4
+    m.Block = block
+    return m
+}
+
+// Whether block a comes after block b, block numbers roll over past 65535
+func BlockAfter(a uint16, b uint16) (bool) {
+    return a != b && a - b < 0x8000
+}
+
+// ---------------------------------
+// Sockets
+// ---------------------------------
+// The kernel charges every queued datagram well above its payload, small
+// blocks cost about as much buffer as large ones
+const datagram_overhead int = 1024
+
+// Linux's usual default, buffers are only ever grown past it
+const default_read_buffer int = 208 * 1024
+
+// A whole window has to fit in the socket buffer or its tail gets dropped,
+// which costs a retransmission timeout. The kernel caps what it grants
+func SizeReadBuffer(conn net.PacketConn, blksize int, windowsize int) {
+    sz := 2 * windowsize * (blksize + datagram_overhead)
+    rb, ok := conn.(interface{ SetReadBuffer(int) error })
+    if windowsize > 1 && sz > default_read_buffer && ok == true {
+        rb.SetReadBuffer(sz)
+    }
+}
+